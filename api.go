@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ReleaseVersion struct {
+	Version    string `json:"version"`
+	Tag        string `json:"tag"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// releaseVersions lists the servable releases newest first, leaving out
+// drafts and, unless asked for, prereleases.
+func releaseVersions(releases []Release, prerelease bool) []ReleaseVersion {
+	var listed []Release
+	for _, r := range releases {
+		if listedRelease(r, prerelease) {
+			listed = append(listed, r)
+		}
+	}
+
+	sort.SliceStable(listed, func(i, j int) bool {
+		return newerRelease(listed[i], listed[j])
+	})
+
+	versions := make([]ReleaseVersion, 0, len(listed))
+	for _, r := range listed {
+		versions = append(versions, ReleaseVersion{Version: releaseVersion(r.TagName), Tag: r.TagName, Prerelease: isPrerelease(r)})
+	}
+	return versions
+}
+
+func listVersions(c echo.Context, org, repo string) error {
+	releases, err := listReleases(c.Request().Context(), org, repo)
+	if err != nil {
+		if errors.Is(err, errUpstreamNotFound) {
+			err = &notFoundError{subject: fmt.Sprintf("repository %s/%s", org, repo), err: err}
+		}
+		return fetchError(err)
+	}
+
+	return c.JSON(http.StatusOK, releaseVersions(releases, allowPrerelease(c)))
+}
+
+func runtimesHandler(c echo.Context) error {
+	return listVersions(c, runtimeOrganization, runtimeRepository)
+}
+
+func releasesHandler(c echo.Context) error {
+	return listVersions(c, c.Param("org"), c.Param("repo"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestVersionListings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/flippingpixels/carimbo/releases":
+			io.WriteString(w, `[{"tag_name":"v9.502.0"},{"tag_name":"v9.502.2"},{"tag_name":"v9.502.1"}]`)
+		case "/repos/o/listing/releases":
+			io.WriteString(w, `[
+				{"tag_name":"v1.0.0"},
+				{"tag_name":"v2.0.0-rc.1","prerelease":true},
+				{"tag_name":"v1.1.0"},
+				{"tag_name":"v3.0.0","draft":true}
+			]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	e := newServer()
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/api/runtimes", []string{"9.502.2", "9.502.1", "9.502.0"}},
+		{"/api/o/listing/releases", []string{"1.1.0", "1.0.0"}},
+		{"/api/o/listing/releases?prerelease=true", []string{"2.0.0-rc.1", "1.1.0", "1.0.0"}},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d: %s", tc.path, rec.Code, rec.Body)
+			continue
+		}
+
+		var listed []ReleaseVersion
+		if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		var got []string
+		for _, v := range listed {
+			got = append(got, v.Version)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GET %s versions = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/o/missing/releases", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET releases of a missing repository = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bodgit/sevenzip"
+)
+
+type BundleEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type BundleIndex struct {
+	Entries []BundleEntry
+	Files   map[string][]byte
+	Size    int64
+}
+
+var errInvalidEntryName = errors.New("invalid entry name")
+
+// Names flagged as non-UTF8 (or simply not valid UTF-8) are kept byte for
+// byte; only the root prefix is ever trimmed, so they are never re-encoded.
+func validEntryName(name string, nonUTF8 bool) error {
+	if name == "" {
+		return errInvalidEntryName
+	}
+
+	if nonUTF8 || !utf8.ValidString(name) {
+		for i := 0; i < len(name); i++ {
+			if name[i] < 0x20 || name[i] == 0x7f {
+				return fmt.Errorf("%w: %q", errInvalidEntryName, name)
+			}
+		}
+		return nil
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %q", errInvalidEntryName, name)
+		}
+	}
+	return nil
+}
+
+func rootDir(names []string) string {
+	var root string
+	for _, name := range names {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return ""
+		}
+		if root == "" {
+			root = name[:i+1]
+		} else if name[:i+1] != root {
+			return ""
+		}
+	}
+	return root
+}
+
+func stripRoot(names []string) []string {
+	root := rootDir(names)
+	stripped := make([]string, 0, len(names))
+	for _, name := range names {
+		stripped = append(stripped, strings.TrimPrefix(name, root))
+	}
+	return stripped
+}
+
+func parseBundle(data []byte) (*BundleIndex, error) {
+	r, err := sevenzip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("7z reader error: %w", err)
+	}
+
+	var files []*sevenzip.File
+	var names []string
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := validEntryName(f.Name, false); err != nil {
+			slog.Warn("skipping bundle entry", "error", err)
+			continue
+		}
+		files = append(files, f)
+		names = append(names, f.Name)
+	}
+
+	index := &BundleIndex{
+		Entries: make([]BundleEntry, 0, len(files)),
+		Files:   make(map[string][]byte, len(files)),
+	}
+
+	for i, name := range stripRoot(names) {
+		content, err := readBundleFile(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("read %s error: %w", name, err)
+		}
+
+		index.Entries = append(index.Entries, BundleEntry{Name: name, Size: int64(len(content)), Hash: contentHash(content)})
+		index.Files[name] = content
+		index.Size += int64(len(content))
+	}
+
+	return index, nil
+}
+
+func readBundleFile(f *sevenzip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open error: %w", err)
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+type indexEntry struct {
+	key   string
+	index *BundleIndex
+}
+
+type BundleIndexCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newBundleIndexCache(maxBytes int64) *BundleIndexCache {
+	return &BundleIndexCache{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (b *BundleIndexCache) Load(key string) (*BundleIndex, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	b.order.MoveToFront(el)
+	return el.Value.(*indexEntry).index, true
+}
+
+func (b *BundleIndexCache) Store(key string, index *BundleIndex) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if index.Size > b.maxBytes {
+		return
+	}
+
+	if el, ok := b.entries[key]; ok {
+		b.size -= el.Value.(*indexEntry).index.Size
+		b.order.Remove(el)
+	}
+
+	b.entries[key] = b.order.PushFront(&indexEntry{key: key, index: index})
+	b.size += index.Size
+
+	for b.size > b.maxBytes {
+		oldest := b.order.Back()
+		entry := oldest.Value.(*indexEntry)
+		b.order.Remove(oldest)
+		delete(b.entries, entry.key)
+		b.size -= entry.index.Size
+	}
+}
+
+// shed evicts least recently used indexes until at least target bytes are
+// freed or none are left, and returns how much it freed.
+func (b *BundleIndexCache) shed(target int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var freed int64
+	for freed < target && b.order.Len() > 0 {
+		oldest := b.order.Back()
+		entry := oldest.Value.(*indexEntry)
+		b.order.Remove(oldest)
+		delete(b.entries, entry.key)
+		b.size -= entry.index.Size
+		freed += entry.index.Size
+	}
+	return freed
+}
+
+func getBundleIndex(ctx context.Context, bundle Bundle) (*BundleIndex, error) {
+	if index, ok := cache.indexes.Load(bundle.Hash); ok {
+		return index, nil
+	}
+
+	release, err := acquireRewrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	defer recordTiming(ctx, "rewrite", time.Now())
+
+	index, err := parseBundle(bundle.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.indexes.Store(bundle.Hash, index)
+	return index, nil
+}
+
+func writeTarGz(w io.Writer, index *BundleIndex, modified time.Time) error {
+	gw, err := gzip.NewWriterLevel(w, dynamicGzipLevel)
+	if err != nil {
+		return fmt.Errorf("gzip writer error: %w", err)
+	}
+
+	tw := tar.NewWriter(gw)
+	for _, entry := range index.Entries {
+		header := &tar.Header{
+			Name:    entry.Name,
+			Mode:    0o644,
+			Size:    entry.Size,
+			ModTime: modified,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("tar header error: %w", err)
+		}
+		if _, err := tw.Write(index.Files[entry.Name]); err != nil {
+			return fmt.Errorf("tar write error: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("tar close error: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("gzip close error: %w", err)
+	}
+	return nil
+}
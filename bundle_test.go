@@ -0,0 +1,634 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf16"
+)
+
+// sevenZipArchive builds an uncompressed 7z archive holding files, given as
+// name/content pairs, each in a folder of its own with the copy coder.
+// Contents must not be empty, since empty streams are not written.
+func sevenZipArchive(t testing.TB, files ...string) []byte {
+	t.Helper()
+
+	number := func(buf *bytes.Buffer, v uint64) {
+		for n := 0; n < 8; n++ {
+			if v>>(8*n) < 1<<(7-n) {
+				buf.WriteByte(byte(0xff<<(8-n)) | byte(v>>(8*n)))
+				for i := 0; i < n; i++ {
+					buf.WriteByte(byte(v >> (8 * i)))
+				}
+				return
+			}
+		}
+		buf.WriteByte(0xff)
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+
+	var packed bytes.Buffer
+	var names, contents []string
+	for i := 0; i+1 < len(files); i += 2 {
+		if files[i+1] == "" {
+			t.Fatalf("7z entry %s is empty", files[i])
+		}
+		names = append(names, files[i])
+		contents = append(contents, files[i+1])
+		packed.WriteString(files[i+1])
+	}
+	count := uint64(len(names))
+
+	var header bytes.Buffer
+	header.WriteByte(0x01) // header
+	header.WriteByte(0x04) // main streams info
+
+	header.WriteByte(0x06) // pack info
+	number(&header, 0)
+	number(&header, count)
+	header.WriteByte(0x09) // sizes
+	for _, content := range contents {
+		number(&header, uint64(len(content)))
+	}
+	header.WriteByte(0x00)
+
+	header.WriteByte(0x07) // unpack info
+	header.WriteByte(0x0b) // folders
+	number(&header, count)
+	header.WriteByte(0x00) // not external
+	for range contents {
+		number(&header, 1)     // one coder
+		header.WriteByte(0x01) // simple coder, one byte id
+		header.WriteByte(0x00) // copy
+	}
+	header.WriteByte(0x0c) // unpack sizes
+	for _, content := range contents {
+		number(&header, uint64(len(content)))
+	}
+	header.WriteByte(0x00)
+
+	header.WriteByte(0x08) // substreams info, one per folder
+	header.WriteByte(0x0a) // digests
+	header.WriteByte(0x01) // all defined
+	for _, content := range contents {
+		binary.Write(&header, binary.LittleEndian, crc32.ChecksumIEEE([]byte(content)))
+	}
+	header.WriteByte(0x00)
+
+	header.WriteByte(0x00) // end of streams info
+
+	header.WriteByte(0x05) // files info
+	number(&header, count)
+	var encoded bytes.Buffer
+	encoded.WriteByte(0x00) // not external
+	for _, name := range names {
+		for _, u := range utf16.Encode([]rune(name)) {
+			binary.Write(&encoded, binary.LittleEndian, u)
+		}
+		encoded.Write([]byte{0, 0})
+	}
+	header.WriteByte(0x11) // names
+	number(&header, uint64(encoded.Len()))
+	header.Write(encoded.Bytes())
+	header.WriteByte(0x00)
+
+	header.WriteByte(0x00) // end of header
+
+	start := make([]byte, 20)
+	binary.LittleEndian.PutUint64(start[0:], uint64(packed.Len()))
+	binary.LittleEndian.PutUint64(start[8:], uint64(header.Len()))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(header.Bytes()))
+
+	var out bytes.Buffer
+	out.Write(sevenZipMagic)
+	out.Write([]byte{0, 4})
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(start))
+	out.Write(start)
+	out.Write(packed.Bytes())
+	out.Write(header.Bytes())
+	return out.Bytes()
+}
+
+func TestContentsListsBundleEntries(t *testing.T) {
+	bundle := sevenZipArchive(t,
+		"game/main.lua", "print('hello')",
+		"game/assets/logo.png", "\x89PNG fake",
+	)
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/o/r/releases/download/v1.0.0/bundle.7z" {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	var first []BundleEntry
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.207.0/o/r/1.0.0/720p/contents.json", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET contents.json = %d: %s", rec.Code, rec.Body)
+		}
+
+		var entries []BundleEntry
+		if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("decode contents.json: %v", err)
+		}
+		if first == nil {
+			first = entries
+		}
+		if len(entries) != len(first) {
+			t.Fatalf("second listing = %v, want %v", entries, first)
+		}
+	}
+
+	sort.Slice(first, func(i, j int) bool { return first[i].Name < first[j].Name })
+	want := []BundleEntry{
+		{Name: "assets/logo.png", Size: int64(len("\x89PNG fake")), Hash: contentHash([]byte("\x89PNG fake"))},
+		{Name: "main.lua", Size: int64(len("print('hello')")), Hash: contentHash([]byte("print('hello')"))},
+	}
+	if len(first) != len(want) {
+		t.Fatalf("contents.json = %+v, want %+v", first, want)
+	}
+	for i := range want {
+		if first[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, first[i], want[i])
+		}
+	}
+
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hits = %d, want the bundle fetched once", n)
+	}
+	if _, ok := cache.indexes.Load(contentHash(bundle)); !ok {
+		t.Error("bundle listing not cached")
+	}
+}
+
+func TestBundleFilesShareOneParse(t *testing.T) {
+	bundle := sevenZipArchive(t,
+		"main.lua", "print('one parse')",
+		"scripts/player.lua", "local player = {}",
+		"assets/font.fnt", "info face=test",
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	var parsed *BundleIndex
+	for _, name := range []string{"main.lua", "scripts/player.lua", "assets/font.fnt"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.211.0/o/r/1.0.0/720p/files/"+name, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET files/%s = %d: %s", name, rec.Code, rec.Body)
+		}
+
+		index, ok := cache.indexes.Load(contentHash(bundle))
+		if !ok {
+			t.Fatalf("no index cached after GET files/%s", name)
+		}
+		if parsed == nil {
+			parsed = index
+		} else if index != parsed {
+			t.Fatalf("GET files/%s parsed the bundle again", name)
+		}
+		if got, want := rec.Body.String(), string(index.Files[name]); got != want {
+			t.Errorf("files/%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestBundleIndexCacheBound(t *testing.T) {
+	c := newBundleIndexCache(10)
+	index := func(size int64) *BundleIndex { return &BundleIndex{Size: size} }
+
+	c.Store("a", index(4))
+	c.Store("b", index(4))
+	c.Load("a")
+	c.Store("c", index(4))
+
+	if _, ok := c.Load("b"); ok {
+		t.Error("least recently used index b survived going over the bound")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Load(key); !ok {
+			t.Errorf("index %s was evicted", key)
+		}
+	}
+
+	c.Store("huge", index(11))
+	if _, ok := c.Load("huge"); ok {
+		t.Error("index larger than the whole bound was cached")
+	}
+}
+
+func TestValidEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		nonUTF8 bool
+		valid   bool
+	}{
+		{"main.lua", false, true},
+		{"assets/ação.png", false, true},
+		{"assets/\x82\xa0.png", true, true},
+		{"assets/\xff.png", false, true},
+		{"", false, false},
+		{"main\x00.lua", false, false},
+		{"main\x00.lua", true, false},
+		{"main\n.lua", false, false},
+		{"main\x7f.lua", true, false},
+	} {
+		err := validEntryName(tc.name, tc.nonUTF8)
+		if tc.valid && err != nil {
+			t.Errorf("validEntryName(%q, %t) = %v, want accepted", tc.name, tc.nonUTF8, err)
+		}
+		if !tc.valid && !errors.Is(err, errInvalidEntryName) {
+			t.Errorf("validEntryName(%q, %t) = %v, want errInvalidEntryName", tc.name, tc.nonUTF8, err)
+		}
+	}
+}
+
+func TestRuntimeSkipsUnsafeZipNames(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		header  zip.FileHeader
+		content string
+	}{
+		{zip.FileHeader{Name: "carimbo.js"}, "console.log('names')"},
+		{zip.FileHeader{Name: "carimbo.wasm"}, "\x00asm names"},
+		{zip.FileHeader{Name: "docs/\x82\xa0.txt", NonUTF8: true}, "legacy"},
+		{zip.FileHeader{Name: "carimbo.js\x00.bak"}, "console.log('evil')"},
+	} {
+		f := f
+		w, err := zw.CreateHeader(&f.header)
+		if err != nil {
+			t.Fatalf("zip create: %v", err)
+		}
+		w.Write([]byte(f.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close: %v", err)
+	}
+	runtimeZip := buf.Bytes()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.217.0/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET carimbo.js = %d: %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); body != "console.log('names')" {
+		t.Errorf("carimbo.js = %q, want the entry with the clean name", body)
+	}
+}
+
+func TestBundleMultiRange(t *testing.T) {
+	bundle := sevenZipArchive(t, "main.lua", strings.Repeat("print('range')\n", 40))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.220.0/o/r/1.0.0/720p/bundle.7z", nil)
+	req.Header.Set("Range", "bytes=0-99,200-299")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("GET bundle.7z with two ranges = %d, want 206: %s", rec.Code, rec.Body)
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", rec.Header().Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for _, want := range [][2]int{{0, 100}, {200, 300}} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		if !bytes.Equal(body, bundle[want[0]:want[1]]) {
+			t.Errorf("part %s does not match bytes %d-%d of the bundle", part.Header.Get("Content-Range"), want[0], want[1]-1)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("after two parts: %v, want io.EOF", err)
+	}
+}
+
+func TestTarGzMatchesBundleFiles(t *testing.T) {
+	bundle := sevenZipArchive(t,
+		"game/main.lua", "print('tar')",
+		"game/assets/logo.png", "\x89PNG tar",
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.224.0/o/r/1.0.0/720p/bundle.tar.gz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET bundle.tar.gz = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/gzip" {
+		t.Errorf("Content-Type = %q, want application/gzip", got)
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	extracted := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar next: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		extracted[hdr.Name] = string(content)
+	}
+
+	if len(extracted) != 2 {
+		t.Fatalf("tar.gz holds %v, want main.lua and assets/logo.png", extracted)
+	}
+	for _, name := range []string{"main.lua", "assets/logo.png"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.224.0/o/r/1.0.0/720p/files/"+name, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET files/%s = %d", name, rec.Code)
+		}
+		if got, ok := extracted[name]; !ok || got != rec.Body.String() {
+			t.Errorf("tar.gz %s = %q, want %q as served from the bundle", name, got, rec.Body)
+		}
+	}
+}
+
+func TestBundleStreamThreshold(t *testing.T) {
+	small := sevenZipArchive(t, "main.lua", "print('small')")
+	large := sevenZipArchive(t, "main.lua", strings.Repeat("print('large')\n", 200))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		switch r.URL.Path {
+		case "/o/small/releases/download/v1.0.0/bundle.7z":
+			body = small
+		case "/o/large/releases/download/v1.0.0/bundle.7z":
+			body = large
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("BUNDLE_STREAM_THRESHOLD", "1024")
+	e := newServer()
+
+	for _, tc := range []struct {
+		repo   string
+		want   []byte
+		cached bool
+	}{
+		{"small", small, true},
+		{"large", large, false},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.225.0/o/"+tc.repo+"/1.0.0/720p/bundle.7z", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s bundle.7z = %d: %s", tc.repo, rec.Code, rec.Body)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), tc.want) {
+			t.Errorf("%s bundle.7z body differs from upstream", tc.repo)
+		}
+
+		_, cached := cache.bundles.load(bundleURL("o", tc.repo, "1.0.0"))
+		if cached != tc.cached {
+			t.Errorf("%s bundle (%d bytes) cached = %t, want %t", tc.repo, len(tc.want), cached, tc.cached)
+		}
+	}
+}
+
+func TestMissingPathSegmentIsRejected(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("CLEAN_PATHS", "false")
+	e := newServer()
+
+	for _, tc := range []struct{ path, missing string }{
+		{"/9.278.0/o/r//720p/bundle.7z", "release"},
+		{"/9.278.0/o//1.0.0/720p/bundle.7z", "repo"},
+		{"/9.278.0//r/1.0.0/720p/contents.json", "org"},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing "+tc.missing) {
+			t.Errorf("GET %s = %d %s, want a 400 naming the missing %s", tc.path, rec.Code, rec.Body, tc.missing)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("upstream hit %d times for malformed paths, want none", n)
+	}
+}
+
+func TestBundleWithoutRuntimeSegment(t *testing.T) {
+	bundle := sevenZipArchive(t, "main.lua", "print('standalone')")
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/o/standalone/releases/download/v1.0.0/bundle.7z" {
+			t.Errorf("runtime-less bundle fetched %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+	cache.bundles.purge(bundleURL("o", "standalone", "1.0.0"))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/o/standalone/1.0.0.7z", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), bundle) {
+		t.Fatalf("GET /o/standalone/1.0.0.7z = %d with %d bytes, want the bundle", rec.Code, rec.Body.Len())
+	}
+
+	// Both URL forms share one cache entry.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.282.0/o/standalone/1.0.0/720p/bundle.7z", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("GET the same bundle under a runtime = %d X-Cache %q, want a cached 200", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hits = %d, want 1", n)
+	}
+
+	for _, path := range []string{"/o/standalone/1.0.0.zip", "/o/standalone/not-a-version.7z"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code == http.StatusOK {
+			t.Errorf("GET %s = 200, want it refused", path)
+		}
+	}
+}
+
+func TestBundleFileRange(t *testing.T) {
+	var level strings.Builder
+	for i := 0; i < 1024; i++ {
+		fmt.Fprintf(&level, "tile %04d\n", i)
+	}
+	content := level.String()
+	bundle := sevenZipArchive(t, "main.lua", "print('ranged')", "levels/world.txt", content)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.284.0/o/ranged/1.0.0/720p/files/levels/world.txt", nil)
+	req.Header.Set("Range", "bytes=5000-5019")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("GET a range of files/levels/world.txt = %d, want 206: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Body.String(); got != content[5000:5020] {
+		t.Errorf("range body = %q, want %q", got, content[5000:5020])
+	}
+	if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 5000-5019/%d", len(content)); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("range response Content-Encoding = %q, want the identity bytes the offsets refer to", got)
+	}
+}
+
+func TestFilesModeIndexLoadsFilesIndividually(t *testing.T) {
+	for _, tc := range []struct {
+		mode       string
+		want, skip string
+	}{
+		{"", `fetch("bundle.7z")`, `fetch("contents.json")`},
+		{"files", `fetch("contents.json")`, `fetch("bundle.7z")`},
+	} {
+		t.Setenv("BUNDLE_MODE", tc.mode)
+		e := newServer()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.503.0/o/r/1.0.0/720p", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("BUNDLE_MODE=%q GET index = %d: %s", tc.mode, rec.Code, rec.Body)
+		}
+
+		body := rec.Body.String()
+		if !strings.Contains(body, tc.want) || strings.Contains(body, tc.skip) {
+			t.Errorf("BUNDLE_MODE=%q index does not load through %s alone:\n%s", tc.mode, tc.want, body)
+		}
+		if preload := strings.Contains(body, `rel="preload" href="bundle.7z"`); preload != (tc.mode == "") {
+			t.Errorf("BUNDLE_MODE=%q index preloads bundle.7z = %t", tc.mode, preload)
+		}
+	}
+}
+
+func TestBundleFileETag(t *testing.T) {
+	bundle := sevenZipArchive(t, "main.lua", "print('etag')", "sprites/hero.png", "\x89PNG hero", "sprites/villain.png", "\x89PNG villain")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+	get := func(name, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/9.503.0/o/etagged/1.0.0/720p/files/"+name, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	hero := get("sprites/hero.png", "")
+	etag := hero.Header().Get("ETag")
+	if hero.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET files/sprites/hero.png = %d with ETag %q, want a 200 with an ETag", hero.Code, etag)
+	}
+	if got := hero.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("files/sprites/hero.png Content-Type = %q, want image/png", got)
+	}
+
+	if rec := get("sprites/hero.png", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET files/sprites/hero.png with its ETag = %d, want 304", rec.Code)
+	}
+	if rec := get("sprites/villain.png", etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("GET files/sprites/villain.png with hero's ETag = %d with ETag %q, want a 200 with its own ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+}
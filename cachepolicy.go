@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var cachePolicies = map[string]string{
+	"alias":     "public, max-age=300, s-maxage=300",
+	"html":      "public, max-age=300, s-maxage=300",
+	"immutable": "public, max-age=31536000, s-maxage=31536000",
+	"none":      "no-store",
+	"page":      "private, no-cache",
+	"wasm":      "public, max-age=31536000, s-maxage=31536000, no-transform",
+}
+
+var maxAgePattern = regexp.MustCompile(`(?:^|[,\s])max-age=(\d+)`)
+
+func cachePolicyDirective(name string) string {
+	return envString("CACHE_CONTROL_"+strings.ToUpper(name), cachePolicies[name])
+}
+
+func cachePolicy(name string) echo.MiddlewareFunc {
+	directive := cachePolicyDirective(name)
+
+	var maxAge time.Duration
+	if m := maxAgePattern.FindStringSubmatch(directive); m != nil {
+		seconds, _ := strconv.Atoi(m[1])
+		maxAge = time.Duration(seconds) * time.Second
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Before(func() {
+				if res.Status >= http.StatusBadRequest || res.Header().Get("Cache-Control") != "" {
+					return
+				}
+
+				res.Header().Set("Cache-Control", directive)
+				if maxAge > 0 {
+					res.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+				}
+			})
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutesGetTheirCachePolicy(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('policy')", "carimbo.wasm", "\x00asm policy")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flippingpixels/carimbo/releases/download/v9.208.0/WebAssembly.zip":
+			w.Write(runtimeZip)
+		case "/repos/flippingpixels/carimbo/releases":
+			io.WriteString(w, `[{"tag_name":"v9.208.0"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("CACHE_CONTROL_HTML", "public, max-age=60")
+	e := newServer()
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/9.208.0/o/r/1.0.0/720p", "private, no-cache"},
+		{"/9.208.0/o/r/1.0.0/720p/carimbo.js", "public, max-age=31536000, s-maxage=31536000"},
+		{"/9.208.0/o/r/1.0.0/720p/carimbo.wasm", "public, max-age=31536000, s-maxage=31536000, no-transform"},
+		{"/api/runtimes", "public, max-age=300, s-maxage=300"},
+		{"/openapi.json", "public, max-age=60"},
+		{"/healthz", "no-store"},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d: %s", tc.path, rec.Code, rec.Body)
+			continue
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("GET %s Cache-Control = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestCachePolicySetsExpiresFromMaxAge(t *testing.T) {
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	if rec.Header().Get("Expires") == "" {
+		t.Error("openapi.json has no Expires alongside its max-age")
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if got := rec.Header().Get("Expires"); got != "" {
+		t.Errorf("healthz Expires = %q, want none for no-store", got)
+	}
+}
+
+func TestWasmNoTransform(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('transform')", "carimbo.wasm", "\x00asm transform")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+
+	for _, tc := range []struct {
+		override string
+		path     string
+		want     bool
+	}{
+		{"", "carimbo.wasm", true},
+		{"", "carimbo.js", false},
+		{"public, max-age=31536000", "carimbo.wasm", false},
+	} {
+		t.Setenv("CACHE_CONTROL_WASM", tc.override)
+		e := newServer()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.219.0/o/r/1.0.0/720p/"+tc.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", tc.path, rec.Code, rec.Body)
+		}
+
+		cc := rec.Header().Get("Cache-Control")
+		if got := strings.Contains(cc, "no-transform"); got != tc.want {
+			t.Errorf("CACHE_CONTROL_WASM=%q GET %s Cache-Control = %q, want no-transform %t", tc.override, tc.path, cc, tc.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// casBundles maps a bundle's SHA-256 to the cache key it was fetched under.
+// Entries leave with the bundle they point at, so the map stays as small as
+// the bundle cache.
+var casBundles sync.Map
+
+func init() {
+	cache.bundles.onEvict = forgetCASBundle
+}
+
+func forgetCASBundle(key string, bundle Bundle) {
+	casBundles.Range(func(sum, target any) bool {
+		if target == key && strings.HasSuffix(sum.(string), bundle.SHA256) {
+			casBundles.Delete(sum)
+		}
+		return true
+	})
+}
+
+func casBundlePath(bundle Bundle) string {
+	return strings.TrimSuffix(os.Getenv("STRIP_PREFIX"), "/") + "/cas-bundle/" + bundle.SHA256 + ".7z"
+}
+
+func casBundleHandler(c echo.Context) error {
+	sum, ok := strings.CutSuffix(c.Param("file"), ".7z")
+	if !ok {
+		return echo.NotFoundHandler(c)
+	}
+
+	key, ok := casBundles.Load(cacheKey(c.Request().Context(), sum))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown bundle hash")
+	}
+
+	cached, ok := cache.bundles.load(key.(string))
+	if !ok || cached.value.SHA256 != sum {
+		casBundles.Delete(cacheKey(c.Request().Context(), sum))
+		return echo.NewHTTPError(http.StatusNotFound, "unknown bundle hash")
+	}
+
+	return serveContent(c, "bundle.7z", "application/octet-stream", cached.value.SHA256, cached.value.Modified, cached.value.Data)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBundleByContentHash(t *testing.T) {
+	bundle := sevenZipArchive(t, "main.lua", "print('cas')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/o/cas/releases/download/v1.0.0/bundle.7z" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.261.0/o/cas/1.0.0/720p/bundle.7z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET bundle.7z = %d: %s", rec.Code, rec.Body)
+	}
+	cas := rec.Header().Get("X-Bundle-CAS")
+	digest := sha256.Sum256(bundle)
+	sum := hex.EncodeToString(digest[:])
+	if cas != "/cas-bundle/"+sum+".7z" {
+		t.Fatalf("X-Bundle-CAS = %q, want the bundle's SHA-256 path", cas)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, cas, nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), bundle) {
+		t.Fatalf("GET %s = %d with %d bytes, want the cached bundle", cas, rec.Code, rec.Body.Len())
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cas-bundle/"+strings.Repeat("0", 64)+".7z", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET an unknown hash = %d, want 404", rec.Code)
+	}
+
+	cache.bundles.purge(bundleURL("o", "cas", "1.0.0"))
+	if _, ok := casBundles.Load(sum); ok {
+		t.Error("hash mapping outlived the evicted bundle")
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, cas, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET %s after its bundle was evicted = %d, want 404", cas, rec.Code)
+	}
+}
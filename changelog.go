@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const noReleaseNotes = "No release notes."
+
+func changelogHandler(c echo.Context) error {
+	version := c.Param("version")
+	if !tagPattern.MatchString(version) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid runtime tag: %s", version))
+	}
+
+	tag := releaseTag(os.Getenv("RUNTIME_TAG_PREFIX"), version)
+
+	release, err := currentProvider().release(c.Request().Context(), runtimeOrganization, runtimeRepository, tag)
+	if errors.Is(err, errUpstreamNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("runtime %s not found", version)).SetInternal(err)
+	}
+	if err != nil {
+		return fetchError(fmt.Errorf("get release error: %w", err))
+	}
+
+	if envString("CHANGELOG_FORMAT", "markdown") == "html" {
+		body := release.BodyHTML
+		if strings.TrimSpace(body) == "" {
+			body = "<p>" + template.HTMLEscapeString(noReleaseNotes) + "</p>"
+		}
+		return c.HTML(http.StatusOK, body)
+	}
+
+	body := release.Body
+	if strings.TrimSpace(body) == "" {
+		body = noReleaseNotes
+	}
+	return c.Blob(http.StatusOK, "text/markdown; charset=utf-8", []byte(body))
+}
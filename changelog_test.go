@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChangelogServesReleaseNotes(t *testing.T) {
+	var hits atomic.Int64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/flippingpixels/carimbo/releases/tags/v9.267.0":
+			hits.Add(1)
+			io.WriteString(w, `{"tag_name":"v9.267.0","body":"## Fixes\n\n- audio resumes after a tab switch","body_html":"<h2>Fixes</h2><ul><li>audio resumes after a tab switch</li></ul>"}`)
+		case "/repos/flippingpixels/carimbo/releases/tags/v9.267.1":
+			io.WriteString(w, `{"tag_name":"v9.267.1","body":"","body_html":""}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	t.Setenv("GITHUB_API_URL", api.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	resetState(t)
+	e := newServer()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/changelog/9.267.0")
+	if rec.Code != http.StatusOK || rec.Body.String() != "## Fixes\n\n- audio resumes after a tab switch" {
+		t.Fatalf("GET /changelog/9.267.0 = %d %q, want the release notes", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/markdown") {
+		t.Errorf("Content-Type = %q, want markdown", got)
+	}
+	if rec := get("/changelog/9.267.1"); rec.Code != http.StatusOK || rec.Body.String() != noReleaseNotes {
+		t.Errorf("GET a release without notes = %d %q, want %q", rec.Code, rec.Body, noReleaseNotes)
+	}
+	if rec := get("/changelog/9.267.9"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET an unknown release = %d, want 404", rec.Code)
+	}
+
+	t.Setenv("CHANGELOG_FORMAT", "html")
+	rec = get("/changelog/9.267.0")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<li>audio resumes after a tab switch</li>") {
+		t.Errorf("GET /changelog/9.267.0 as HTML = %d %q, want the rendered notes", rec.Code, rec.Body)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("release fetched %d times, want its notes cached", n)
+	}
+}
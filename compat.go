@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Manifest struct {
+	Runtime string `json:"runtime"`
+}
+
+type Compat struct {
+	Organization string `json:"org"`
+	Repository   string `json:"repo"`
+	Release      string `json:"release"`
+	Runtime      string `json:"runtime"`
+}
+
+func bundleManifest(index *BundleIndex) (Manifest, error) {
+	manifest := Manifest{}
+
+	content, ok := index.Files["carimbo.json"]
+	if !ok {
+		return manifest, nil
+	}
+
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("parse carimbo.json error: %w", err)
+	}
+	return manifest, nil
+}
+
+func compatHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
+
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	bundle, status, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+	setCacheStatus(c, status)
+
+	index, err := getBundleIndex(c.Request().Context(), bundle)
+	if err != nil {
+		return fmt.Errorf("bundle index error: %w", err)
+	}
+
+	manifest, err := bundleManifest(index)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "invalid carimbo.json").SetInternal(err)
+	}
+
+	if manifest.Runtime == "" {
+		manifest.Runtime = "*"
+	}
+
+	return c.JSON(http.StatusOK, Compat{
+		Organization: p.Organization,
+		Repository:   p.Repository,
+		Release:      p.Release,
+		Runtime:      manifest.Runtime,
+	})
+}
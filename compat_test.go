@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompatReadsCarimboJSON(t *testing.T) {
+	bundles := map[string][]byte{
+		"declared":   sevenZipArchive(t, "game/carimbo.json", `{"runtime": ">=1.2.0 <2.0.0"}`, "game/main.lua", "print('compat')"),
+		"undeclared": sevenZipArchive(t, "main.lua", "print('compat')"),
+		"broken":     sevenZipArchive(t, "carimbo.json", "{runtime", "main.lua", "print('compat')"),
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The compat route has no runtime segment, so it resolves latest.
+		if r.URL.Path == "/repos/flippingpixels/carimbo/releases" {
+			io.WriteString(w, `[{"tag_name":"v9.228.0"}]`)
+			return
+		}
+		for repo, bundle := range bundles {
+			if r.URL.Path == "/o/"+repo+"/releases/download/v1.0.0/bundle.7z" {
+				w.Write(bundle)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("LATEST_TTL", "1ns")
+	e := newServer()
+
+	for _, tc := range []struct {
+		repo    string
+		runtime string
+	}{
+		{"declared", ">=1.2.0 <2.0.0"},
+		{"undeclared", "*"},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compat/o/"+tc.repo+"/1.0.0", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /compat/o/%s/1.0.0 = %d: %s", tc.repo, rec.Code, rec.Body)
+		}
+
+		var got Compat
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode compat: %v", err)
+		}
+		want := Compat{Organization: "o", Repository: tc.repo, Release: "1.0.0", Runtime: tc.runtime}
+		if got != want {
+			t.Errorf("compat for %s = %+v, want %+v", tc.repo, got, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compat/o/broken/1.0.0", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("compat with a malformed carimbo.json = %d, want 422", rec.Code)
+	}
+}
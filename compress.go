@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// Higher levels shrink the precompressed copies further at the cost of CPU
+// time on every cache fill; since runtimes are compressed once and served
+// many times, bandwidth-constrained deployments usually want the maximum,
+// while CPU-constrained ones should lower the levels to shorten cold fetches.
+var (
+	gzipLevel   = compressionLevel("GZIP_LEVEL", gzip.BestCompression, gzip.HuffmanOnly, gzip.BestCompression)
+	brotliLevel = compressionLevel("BROTLI_LEVEL", brotli.BestCompression, brotli.BestSpeed, brotli.BestCompression)
+	zstdLevel   = compressionLevel("ZSTD_LEVEL", 19, 1, 22)
+
+	// Responses compressed on the fly pay for the level on every request, so
+	// they stay at the library default unless GZIP_DYNAMIC_LEVEL says otherwise.
+	dynamicGzipLevel = compressionLevel("GZIP_DYNAMIC_LEVEL", gzip.DefaultCompression, gzip.HuffmanOnly, gzip.BestCompression)
+)
+
+func compressionLevel(key string, fallback, lo, hi int) int {
+	level := envInt(key, fallback)
+	if level < lo || level > hi {
+		slog.Warn("compression level out of range, using default", "key", key, "value", level, "min", lo, "max", hi, "default", fallback)
+		return fallback
+	}
+	return level
+}
+
+// In "stream" mode the wasm is gzipped per response instead of keeping
+// precompressed copies next to it, trading CPU on every request for memory.
+func streamWasmCompression() bool {
+	return envString("WASM_COMPRESSION", "precompute") == "stream"
+}
+
+type Encoded map[string][]byte
+
+func precompress(data []byte) (Encoded, error) {
+	var gz bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&gz, gzipLevel)
+	if err != nil {
+		return nil, fmt.Errorf("gzip writer error: %w", err)
+	}
+	if _, err := gw.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip write error: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close error: %w", err)
+	}
+
+	var br bytes.Buffer
+	bw := brotli.NewWriterLevel(&br, brotliLevel)
+	if _, err := bw.Write(data); err != nil {
+		return nil, fmt.Errorf("brotli write error: %w", err)
+	}
+	if err := bw.Close(); err != nil {
+		return nil, fmt.Errorf("brotli close error: %w", err)
+	}
+
+	zw, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)))
+	if err != nil {
+		return nil, fmt.Errorf("zstd writer error: %w", err)
+	}
+	zs := zw.EncodeAll(data, nil)
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("zstd close error: %w", err)
+	}
+
+	return Encoded{"zstd": zs, "br": br.Bytes(), "gzip": gz.Bytes()}, nil
+}
+
+// acceptedEncodings parses Accept-Encoding into q-values keyed by lowercase
+// coding, "*" included when present.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+func allowedEncodings() []string {
+	var allowed []string
+	for _, encoding := range strings.Split(envString("ACCEPT_ENCODINGS", "zstd,br,gzip"), ",") {
+		if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" {
+			allowed = append(allowed, encoding)
+		}
+	}
+	return allowed
+}
+
+// negotiateEncoding picks the allowed encoding the client weights highest,
+// breaking ties by ACCEPT_ENCODINGS order, or "" for identity. Codings outside
+// the allowlist are ignored whatever the client claims.
+func negotiateEncoding(header string, encoded Encoded) string {
+	accepted := acceptedEncodings(header)
+
+	best, bestQ := "", 0.0
+	for _, encoding := range allowedEncodings() {
+		if _, ok := encoded[encoding]; !ok {
+			continue
+		}
+
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// skipGzip leaves precompressed assets alone, along with everything served
+// through http.ServeContent: a gzipped 206 would carry identity offsets in
+// Content-Range over a compressed body.
+func skipGzip(c echo.Context) bool {
+	if c.Request().Header.Get("Range") != "" {
+		return true
+	}
+
+	path := c.Request().URL.Path
+	if strings.Contains(path, "/files/") {
+		return true
+	}
+	for _, suffix := range []string{"/carimbo.js", "/carimbo.wasm", ".7z", "/bundle.tar.gz"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodingSuffixes keep strong ETags distinct per representation, as RFC 9110
+// requires, so caches and If-Range never mix up one encoding for another.
+var encodingSuffixes = map[string]string{"gzip": "-gz", "br": "-br", "zstd": "-zst"}
+
+// blobEncoded serves data through http.ServeContent so clients get
+// Accept-Ranges and partial responses; range requests always receive the
+// identity representation so offsets refer to the uncompressed bytes. A
+// non-empty tag is sent as the ETag of the chosen representation and answers
+// a matching If-None-Match with a 304.
+func blobEncoded(c echo.Context, contentType, tag string, data []byte, encoded Encoded) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+	encoding := ""
+	if c.Request().Header.Get("Range") == "" {
+		encoding = negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding), encoded)
+	}
+	if tag != "" && notModified(c, tag+encodingSuffixes[encoding]) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	if encoding != "" {
+		c.Response().Header().Set(echo.HeaderContentEncoding, encoding)
+		data = encoded[encoding]
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	setContentDigest(c, data)
+
+	w := contextWriter{ResponseWriter: c.Response(), ctx: c.Request().Context()}
+	http.ServeContent(w, c.Request(), "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+func streamGzip(c echo.Context, contentType, tag string, data []byte) error {
+	if c.Request().Header.Get("Range") != "" || negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding), Encoded{"gzip": nil}) == "" {
+		return blobEncoded(c, contentType, tag, data, nil)
+	}
+
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if tag != "" && notModified(c, tag+encodingSuffixes["gzip"]) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	c.Response().Header().Set(echo.HeaderContentEncoding, "gzip")
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().WriteHeader(http.StatusOK)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+
+	gw, err := gzip.NewWriterLevel(contextWriter{ResponseWriter: c.Response(), ctx: c.Request().Context()}, dynamicGzipLevel)
+	if err != nil {
+		return fmt.Errorf("gzip writer error: %w", err)
+	}
+	if _, err := gw.Write(data); err != nil {
+		return fmt.Errorf("gzip write error: %w", err)
+	}
+	return gw.Close()
+}
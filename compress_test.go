@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressionLevelFromEnv(t *testing.T) {
+	t.Setenv("GZIP_LEVEL", "3")
+	if got := compressionLevel("GZIP_LEVEL", gzip.BestCompression, gzip.HuffmanOnly, gzip.BestCompression); got != 3 {
+		t.Errorf("GZIP_LEVEL=3 gives level %d", got)
+	}
+
+	t.Setenv("GZIP_LEVEL", "42")
+	if got := compressionLevel("GZIP_LEVEL", gzip.BestCompression, gzip.HuffmanOnly, gzip.BestCompression); got != gzip.BestCompression {
+		t.Errorf("out of range GZIP_LEVEL gives level %d, want the default %d", got, gzip.BestCompression)
+	}
+
+	t.Setenv("BROTLI_LEVEL", "-1")
+	if got := compressionLevel("BROTLI_LEVEL", brotli.BestCompression, brotli.BestSpeed, brotli.BestCompression); got != brotli.BestCompression {
+		t.Errorf("out of range BROTLI_LEVEL gives level %d, want the default %d", got, brotli.BestCompression)
+	}
+
+	if got := compressionLevel("GZIP_DYNAMIC_LEVEL", gzip.DefaultCompression, gzip.HuffmanOnly, gzip.BestCompression); got != gzip.DefaultCompression {
+		t.Errorf("unset GZIP_DYNAMIC_LEVEL gives level %d, want the library default", got)
+	}
+}
+
+func TestPrecompressUsesConfiguredLevels(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&data, "function f%d() { return %d * %d; }\n", i, i, i%7)
+	}
+
+	sizes := func(gz, br int) (int, int) {
+		previousGzip, previousBrotli := gzipLevel, brotliLevel
+		gzipLevel, brotliLevel = gz, br
+		defer func() { gzipLevel, brotliLevel = previousGzip, previousBrotli }()
+
+		encoded, err := precompress(data.Bytes())
+		if err != nil {
+			t.Fatalf("precompress: %v", err)
+		}
+		return len(encoded["gzip"]), len(encoded["br"])
+	}
+
+	fastGzip, fastBrotli := sizes(gzip.HuffmanOnly, brotli.BestSpeed)
+	bestGzip, bestBrotli := sizes(gzip.BestCompression, brotli.BestCompression)
+
+	if bestGzip >= fastGzip {
+		t.Errorf("gzip at best compression is %d bytes, not smaller than %d at Huffman only", bestGzip, fastGzip)
+	}
+	if bestBrotli >= fastBrotli {
+		t.Errorf("brotli at best compression is %d bytes, not smaller than %d at best speed", bestBrotli, fastBrotli)
+	}
+}
+
+func TestStreamedWasmGzip(t *testing.T) {
+	wasm := "\x00asm" + strings.Repeat("streamed wasm ", 4096)
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('stream')", "carimbo.wasm", wasm)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("WASM_COMPRESSION", "stream")
+	e := newServer()
+	cache.runtimes.purge("9.258.0")
+
+	req := httptest.NewRequest(http.MethodGet, "/9.258.0/o/r/1.0.0/720p/carimbo.wasm", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET carimbo.wasm = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	body, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("decompress carimbo.wasm: %v", err)
+	}
+	if string(body) != wasm {
+		t.Errorf("streamed gzip decompresses to %d bytes, want the original %d byte wasm", len(body), len(wasm))
+	}
+
+	runtime, ok := cache.runtimes.load("9.258.0")
+	if !ok {
+		t.Fatal("runtime was not cached")
+	}
+	if len(runtime.value.BinaryEncoded) != 0 {
+		t.Errorf("stream mode kept precompressed wasm copies: %v", len(runtime.value.BinaryEncoded))
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	script := "console.log('zstd');" + strings.Repeat(" // padding", 256)
+	runtimeZip := zipArchive(t, "carimbo.js", script, "carimbo.wasm", "\x00asm zstd")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for _, accept := range []string{"zstd", "gzip, br, zstd"} {
+		req := httptest.NewRequest(http.MethodGet, "/9.281.0/o/r/1.0.0/720p/carimbo.js", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET carimbo.js = %d: %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "zstd" {
+			t.Errorf("Accept-Encoding %q served Content-Encoding %q, want zstd", accept, got)
+			continue
+		}
+
+		zr, err := zstd.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("zstd reader: %v", err)
+		}
+		body, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			t.Fatalf("decompress carimbo.js: %v", err)
+		}
+		if string(body) != script {
+			t.Errorf("Accept-Encoding %q zstd body decompresses to %q, want the original script", accept, body)
+		}
+	}
+}
+
+func TestNegotiateEncodingAllowlist(t *testing.T) {
+	encoded := Encoded{"zstd": nil, "br": nil, "gzip": nil}
+	for _, tc := range []struct {
+		allow, header, want string
+	}{
+		{"", "x-snappy, gzip", "gzip"},
+		{"", "compress;q=1, deflate;q=1, gzip;q=0.5", "gzip"},
+		{"", "x-snappy", ""},
+		{"", "gzip;q=0.2, br;q=0.8", "br"},
+		{"", "gzip, br, zstd", "zstd"},
+		{"", "*", "zstd"},
+		{"", "br;q=0, *;q=0.5", "zstd"},
+		{"gzip,br", "zstd, br", "br"},
+		{"gzip,br", "zstd", ""},
+		{"gzip,br,x-snappy", "x-snappy, gzip", "gzip"},
+	} {
+		t.Setenv("ACCEPT_ENCODINGS", tc.allow)
+		if got := negotiateEncoding(tc.header, encoded); got != tc.want {
+			t.Errorf("ACCEPT_ENCODINGS=%q Accept-Encoding %q = %q, want %q", tc.allow, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestUnsupportedEncodingFallsBackToGzip(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('allowlist')", "carimbo.wasm", "\x00asm allowlist")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.286.0/o/r/1.0.0/720p/carimbo.js", nil)
+	req.Header.Set("Accept-Encoding", "x-snappy;q=1, gzip;q=0.5")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Accept-Encoding with an unsupported coding and gzip served %q, want gzip", got)
+	}
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	if body, _ := io.ReadAll(gr); string(body) != "console.log('allowlist')" {
+		t.Errorf("gzip body decompresses to %q", body)
+	}
+}
+
+func TestETagDiffersPerEncoding(t *testing.T) {
+	script := "console.log('variants');" + strings.Repeat(" // padding", 256)
+	runtimeZip := zipArchive(t, "carimbo.js", script, "carimbo.wasm", "\x00asm variants")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	resetState(t)
+	e := newServer()
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/9.281.0/o/r/1.0.0/720p/carimbo.js", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	etags := map[string]string{}
+	for _, accept := range []string{"identity", "gzip", "br", "zstd"} {
+		rec := get(accept, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET carimbo.js with %s = %d: %s", accept, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Vary"); !strings.Contains(got, "Accept-Encoding") {
+			t.Errorf("%s response Vary = %q, want Accept-Encoding", accept, got)
+		}
+		etag := rec.Header().Get("ETag")
+		for other, seen := range etags {
+			if seen == etag {
+				t.Errorf("%s and %s representations share the ETag %s", accept, other, etag)
+			}
+		}
+		etags[accept] = etag
+	}
+
+	if rec := get("br", etags["br"]); rec.Code != http.StatusNotModified {
+		t.Errorf("GET br with its own ETag = %d, want 304", rec.Code)
+	}
+	if rec := get("br", etags["gzip"]); rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("GET br with the gzip ETag = %d %q, want a 200 br body", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+}
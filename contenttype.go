@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var mimeOverrides = loadMimeOverrides(os.Getenv("MIME_OVERRIDES"))
+
+func loadMimeOverrides(spec string) map[string]string {
+	overrides := map[string]string{
+		".glsl": "text/plain",
+		".js":   "application/javascript",
+		".json": "application/json",
+		".lua":  "text/x-lua",
+		".wasm": "application/wasm",
+		".webp": "image/webp",
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		ext, typ, ok := strings.Cut(pair, "=")
+		ext, typ = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(typ)
+		if !ok || ext == "" || typ == "" {
+			slog.Warn("ignoring invalid mime override", "value", pair)
+			continue
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		overrides[ext] = typ
+	}
+
+	return overrides
+}
+
+func textual(mediaType string) bool {
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json")
+}
+
+func withCharset(typ string) string {
+	mediaType, params, err := mime.ParseMediaType(typ)
+	if err != nil || !textual(mediaType) {
+		return typ
+	}
+	if _, ok := params["charset"]; ok {
+		return typ
+	}
+	return typ + "; charset=utf-8"
+}
+
+func contentType(name string, content []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if typ, ok := mimeOverrides[ext]; ok {
+		return withCharset(typ)
+	}
+
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return withCharset(typ)
+	}
+
+	return http.DetectContentType(content)
+}
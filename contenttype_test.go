@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoadMimeOverrides(t *testing.T) {
+	overrides := loadMimeOverrides("frag=text/x-glsl-fragment, .LUA = text/x-luau ,broken,=x/y")
+
+	for ext, want := range map[string]string{
+		".frag": "text/x-glsl-fragment",
+		".lua":  "text/x-luau",
+		".wasm": "application/wasm",
+	} {
+		if got := overrides[ext]; got != want {
+			t.Errorf("override for %s = %q, want %q", ext, got, want)
+		}
+	}
+	if _, ok := overrides[".broken"]; ok {
+		t.Error("entry without a type was accepted")
+	}
+}
+
+func TestBundleFileUsesMimeOverride(t *testing.T) {
+	previous := mimeOverrides
+	mimeOverrides = loadMimeOverrides("frag=text/x-glsl-fragment")
+	t.Cleanup(func() { mimeOverrides = previous })
+
+	bundle := sevenZipArchive(t,
+		"shaders/light.frag", "void main() {}",
+		"main.lua", "print('mime')",
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for name, want := range map[string]string{
+		"shaders/light.frag": "text/x-glsl-fragment; charset=utf-8",
+		"main.lua":           "text/x-lua; charset=utf-8",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.226.0/o/r/1.0.0/720p/files/"+name, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET files/%s = %d: %s", name, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); got != want {
+			t.Errorf("files/%s Content-Type = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestContentTypeCharset(t *testing.T) {
+	for name, want := range map[string]string{
+		"carimbo.js":   "application/javascript; charset=utf-8",
+		"index.html":   "text/html; charset=utf-8",
+		"data.json":    "application/json; charset=utf-8",
+		"carimbo.wasm": "application/wasm",
+		"bundle.zip":   "application/zip",
+		"logo.png":     "image/png",
+	} {
+		if got := contentType(name, nil); got != want {
+			t.Errorf("contentType(%s) = %q, want %q", name, got, want)
+		}
+	}
+
+	if got := withCharset("text/plain; charset=iso-8859-1"); got != "text/plain; charset=iso-8859-1" {
+		t.Errorf("withCharset kept = %q, want the declared charset untouched", got)
+	}
+}
+
+func TestRuntimeResponseCharset(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('charset')", "carimbo.wasm", "\x00asm charset")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for path, want := range map[string]string{
+		"":              "text/html; charset=utf-8",
+		"/carimbo.js":   "application/javascript; charset=utf-8",
+		"/carimbo.wasm": "application/wasm",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.249.0/o/r/1.0.0/720p"+path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, rec.Code, rec.Body)
+		}
+		// Charset names are case-insensitive; echo writes UTF-8.
+		if got := rec.Header().Get("Content-Type"); !strings.EqualFold(got, want) {
+			t.Errorf("GET %s Content-Type = %q, want %q", path, got, want)
+		}
+	}
+}
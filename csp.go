@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}' 'wasm-unsafe-eval'; " +
+	"style-src 'self' 'nonce-{nonce}'; " +
+	"img-src 'self' data: blob:; " +
+	"connect-src 'self'; " +
+	"worker-src 'self' blob:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'"
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func contentSecurityPolicy(nonce string) string {
+	return strings.ReplaceAll(envString("CONTENT_SECURITY_POLICY", defaultContentSecurityPolicy), "{nonce}", nonce)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	stdhtml "html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+var (
+	headerNonce = regexp.MustCompile(`'nonce-([^']+)'`)
+	htmlNonce   = regexp.MustCompile(`nonce="([^"]*)"`)
+)
+
+func TestIndexNonceMatchesCSP(t *testing.T) {
+	e := newServer()
+
+	var previous string
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.232.0/o/r/1.0.0/720p", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET index = %d: %s", rec.Code, rec.Body)
+		}
+
+		m := headerNonce.FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+		if m == nil {
+			t.Fatalf("Content-Security-Policy %q carries no nonce", rec.Header().Get("Content-Security-Policy"))
+		}
+		nonce := m[1]
+
+		tags := htmlNonce.FindAllStringSubmatch(rec.Body.String(), -1)
+		if len(tags) == 0 {
+			t.Fatal("index has no nonce attributes")
+		}
+		for _, tag := range tags {
+			// The template escapes + in attributes, which browsers decode.
+			if got := stdhtml.UnescapeString(tag[1]); got != nonce {
+				t.Errorf("inline tag nonce %q, want the header nonce %q", got, nonce)
+			}
+		}
+
+		if nonce == previous {
+			t.Errorf("two renders shared the nonce %q", nonce)
+		}
+		previous = nonce
+	}
+}
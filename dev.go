@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// devProject serves a local game directory in place of a release bundle, so
+// `play -dev ./mygame -runtime 1.2.3` works as the edit-and-reload loop. The
+// page loads the directory file by file, as in BUNDLE_MODE=files, and
+// reloads itself whenever the watcher sees the directory change.
+type devProject struct {
+	dir     string
+	files   fs.FS
+	runtime string
+	format  string
+
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+func newDevProject(dir, runtime, format string) (*devProject, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("stat error: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if runtime != latestAlias && !tagPattern.MatchString(runtime) {
+		return nil, fmt.Errorf("invalid runtime tag: %s", runtime)
+	}
+
+	if _, ok := formats[format]; !ok {
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+
+	return &devProject{
+		dir:     dir,
+		files:   os.DirFS(dir),
+		runtime: runtime,
+		format:  format,
+		clients: map[chan struct{}]struct{}{},
+	}, nil
+}
+
+func (d *devProject) register(e *echo.Echo) {
+	policy := cachePolicy("none")
+	asset := []string{http.MethodGet, http.MethodHead}
+
+	e.Match(asset, "/", d.indexHandler, policy)
+	e.Match(asset, "/dev/carimbo.js", d.runtimeHandler("carimbo.js"), policy)
+	e.Match(asset, "/dev/carimbo.wasm", d.runtimeHandler("carimbo.wasm"), policy)
+	e.Match(asset, "/dev/contents.json", d.contentsHandler, policy)
+	e.Match(asset, "/dev/files/*", d.fileHandler, policy)
+	e.Match(asset, "/dev/assets/*", assetsHandler(assets), policy)
+	e.GET("/dev/events", d.eventsHandler, policy)
+}
+
+func (d *devProject) resolveRuntime(c echo.Context) (string, error) {
+	if d.runtime != latestAlias {
+		return d.runtime, nil
+	}
+
+	version, err := resolveLatest(c.Request().Context(), runtimeOrganization, runtimeRepository, allowPrerelease(c))
+	if err != nil {
+		return "", fmt.Errorf("resolve runtime error: %w", err)
+	}
+	return version, nil
+}
+
+func (d *devProject) indexHandler(c echo.Context) error {
+	runtime, err := d.resolveRuntime(c)
+	if err != nil {
+		return err
+	}
+
+	format := formats[d.format]
+	source, _ := indexSource()
+	return renderIndex(c, source, indexData{
+		BaseURL: "/dev/",
+		Runtime: runtime,
+		Width:   format.width,
+		Height:  format.height,
+		Files:   true,
+		Dev:     true,
+	})
+}
+
+func (d *devProject) runtimeHandler(name string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		version, err := d.resolveRuntime(c)
+		if err != nil {
+			return err
+		}
+
+		runtime, status, err := getRuntime(c.Request().Context(), version)
+		if err != nil {
+			return fetchError(fmt.Errorf("get runtime error: %w", err))
+		}
+		setCacheStatus(c, status)
+
+		if name == "carimbo.wasm" {
+			return blobEncoded(c, contentType(name, nil), "", runtime.Binary, runtime.BinaryEncoded)
+		}
+		return blobEncoded(c, contentType(name, nil), "", runtime.Script, runtime.ScriptEncoded)
+	}
+}
+
+// visible skips dotfiles and dot-directories such as .git, which are never
+// part of a packaged game.
+func visible(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *devProject) walk(fn func(name string, info fs.FileInfo) error) error {
+	return fs.WalkDir(d.files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && !visible(name) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(name, info)
+	})
+}
+
+func (d *devProject) contentsHandler(c echo.Context) error {
+	entries := []BundleEntry{}
+	err := d.walk(func(name string, info fs.FileInfo) error {
+		content, err := fs.ReadFile(d.files, name)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, BundleEntry{Name: name, Size: info.Size(), Hash: contentHash(content)})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk error: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+func (d *devProject) fileHandler(c echo.Context) error {
+	name := c.Param("*")
+	if !fs.ValidPath(name) || !visible(name) {
+		return echo.ErrNotFound
+	}
+
+	content, err := fs.ReadFile(d.files, name)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	return serveContent(c, path.Base(name), contentType(name, content), contentHash(content), time.Time{}, content)
+}
+
+// fingerprint summarises names, sizes and modification times, which is
+// enough to notice an edit without reading every file on each poll.
+func (d *devProject) fingerprint() (string, error) {
+	h := sha1.New()
+	err := d.walk(func(name string, info fs.FileInfo) error {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return fmt.Sprintf("%x", h.Sum(nil)), err
+}
+
+func (d *devProject) watch(ctx context.Context, interval time.Duration) {
+	last, err := d.fingerprint()
+	if err != nil {
+		slog.Warn("dev watch failed", "dir", d.dir, "error", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := d.fingerprint()
+		if err != nil {
+			slog.Warn("dev watch failed", "dir", d.dir, "error", err)
+			continue
+		}
+		if current == last {
+			continue
+		}
+		last = current
+
+		slog.Info("dev files changed, reloading", "dir", d.dir)
+		d.broadcast()
+	}
+}
+
+func (d *devProject) broadcast() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for client := range d.clients {
+		select {
+		case client <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *devProject) subscribe() (chan struct{}, func()) {
+	client := make(chan struct{}, 1)
+
+	d.mu.Lock()
+	d.clients[client] = struct{}{}
+	d.mu.Unlock()
+
+	return client, func() {
+		d.mu.Lock()
+		delete(d.clients, client)
+		d.mu.Unlock()
+	}
+}
+
+func (d *devProject) eventsHandler(c echo.Context) error {
+	client, unsubscribe := d.subscribe()
+	defer unsubscribe()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	fmt.Fprint(c.Response(), ": connected\n\n")
+	c.Response().Flush()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-client:
+			fmt.Fprint(c.Response(), "event: reload\ndata: {}\n\n")
+			c.Response().Flush()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func devDirectory(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestNewDevProjectValidatesArguments(t *testing.T) {
+	dir := devDirectory(t, map[string]string{"main.lua": "print('dev')"})
+
+	for _, tc := range []struct {
+		dir, runtime, format string
+	}{
+		{filepath.Join(dir, "missing"), "1.0.0", "720p"},
+		{filepath.Join(dir, "main.lua"), "1.0.0", "720p"},
+		{dir, "not a tag", "720p"},
+		{dir, "1.0.0", "4k"},
+	} {
+		if _, err := newDevProject(tc.dir, tc.runtime, tc.format); err == nil {
+			t.Errorf("newDevProject(%s, %s, %s) succeeded, want an error", filepath.Base(tc.dir), tc.runtime, tc.format)
+		}
+	}
+}
+
+func TestDevProjectServesLocalDirectory(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('dev')", "carimbo.wasm", "\x00asm dev")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/flippingpixels/carimbo/releases/download/v9.507.0/WebAssembly.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	dir := devDirectory(t, map[string]string{
+		"main.lua":         "print('dev')",
+		"sprites/hero.png": "\x89PNG hero",
+		".git/config":      "[core]",
+	})
+	project, err := newDevProject(dir, "9.507.0", "720p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newServer()
+	project.register(e)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	index := get("/")
+	if index.Code != http.StatusOK {
+		t.Fatalf("GET / = %d: %s", index.Code, index.Body)
+	}
+	for _, want := range []string{`<base href="/dev/"`, `content="9.507.0"`, `fetch("contents.json")`, `new EventSource("events")`} {
+		if !strings.Contains(index.Body.String(), want) {
+			t.Errorf("dev index is missing %s:\n%s", want, index.Body)
+		}
+	}
+
+	var entries []BundleEntry
+	if err := json.Unmarshal(get("/dev/contents.json").Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode contents.json: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if got := strings.Join(names, ","); got != "main.lua,sprites/hero.png" {
+		t.Errorf("contents.json lists %s, want the visible files only", got)
+	}
+
+	if rec := get("/dev/files/main.lua"); rec.Code != http.StatusOK || rec.Body.String() != "print('dev')" {
+		t.Errorf("GET /dev/files/main.lua = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get("/dev/files/.git/config"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /dev/files/.git/config = %d, want 404", rec.Code)
+	}
+	if rec := get("/dev/carimbo.js"); rec.Code != http.StatusOK || rec.Body.String() != "console.log('dev')" {
+		t.Errorf("GET /dev/carimbo.js = %d: %s", rec.Code, rec.Body)
+	}
+
+	// Edits show up on the next request, with nothing cached.
+	if err := os.WriteFile(filepath.Join(dir, "main.lua"), []byte("print('edited')"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/dev/files/main.lua"); rec.Body.String() != "print('edited')" {
+		t.Errorf("GET /dev/files/main.lua after an edit = %q", rec.Body)
+	}
+}
+
+func TestDevProjectPushesReloadOnChange(t *testing.T) {
+	dir := devDirectory(t, map[string]string{"main.lua": "print('dev')"})
+	project, err := newDevProject(dir, "9.507.0", "720p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newServer()
+	project.register(e)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/dev/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("GET /dev/events Content-Type = %q, want text/event-stream", got)
+	}
+
+	events := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			events <- scanner.Text()
+		}
+		close(events)
+	}()
+	if line := <-events; line != ": connected" {
+		t.Fatalf("first event line = %q, want the connected comment", line)
+	}
+
+	go project.watch(ctx, 10*time.Millisecond)
+
+	// Keep editing until the watcher, which fingerprints the directory when
+	// it starts, has seen a change.
+	deadline := time.After(5 * time.Second)
+	edit := time.NewTicker(20 * time.Millisecond)
+	defer edit.Stop()
+	for i := 0; ; i++ {
+		select {
+		case line, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed before a reload")
+			}
+			if line == "event: reload" {
+				return
+			}
+		case <-edit.C:
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("level%d.lua", i)), []byte("-- level"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		case <-deadline:
+			t.Fatal("no reload event after editing the directory")
+		}
+	}
+}
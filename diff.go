@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ChangedEntry struct {
+	Name     string `json:"name"`
+	FromSize int64  `json:"from_size"`
+	ToSize   int64  `json:"to_size"`
+	FromHash string `json:"from_hash"`
+	ToHash   string `json:"to_hash"`
+}
+
+type BundleDiff struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Added   []BundleEntry  `json:"added"`
+	Removed []BundleEntry  `json:"removed"`
+	Changed []ChangedEntry `json:"changed"`
+}
+
+func diffIndexes(from, to *BundleIndex) BundleDiff {
+	diff := BundleDiff{Added: []BundleEntry{}, Removed: []BundleEntry{}, Changed: []ChangedEntry{}}
+
+	previous := make(map[string]BundleEntry, len(from.Entries))
+	for _, entry := range from.Entries {
+		previous[entry.Name] = entry
+	}
+
+	for _, entry := range to.Entries {
+		old, ok := previous[entry.Name]
+		if !ok {
+			diff.Added = append(diff.Added, entry)
+			continue
+		}
+		delete(previous, entry.Name)
+
+		if old.Hash != entry.Hash {
+			diff.Changed = append(diff.Changed, ChangedEntry{
+				Name:     entry.Name,
+				FromSize: old.Size,
+				ToSize:   entry.Size,
+				FromHash: old.Hash,
+				ToHash:   entry.Hash,
+			})
+		}
+	}
+
+	for _, entry := range from.Entries {
+		if _, ok := previous[entry.Name]; ok {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+
+	return diff
+}
+
+func releaseIndex(ctx context.Context, org, repo, release string) (*BundleIndex, error) {
+	bundle, _, err := getBundle(ctx, org, repo, release)
+	if err != nil {
+		return nil, fetchError(fmt.Errorf("get bundle %s error: %w", release, err))
+	}
+
+	index, err := getBundleIndex(ctx, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("bundle index %s error: %w", release, err)
+	}
+	return index, nil
+}
+
+func diffHandler(c echo.Context) error {
+	org, repo := c.Param("org"), c.Param("repo")
+	from, to := c.Param("from"), c.Param("to")
+
+	for _, tag := range []string{from, to} {
+		if !tagPattern.MatchString(tag) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid release tag: %s", tag))
+		}
+	}
+
+	ctx := c.Request().Context()
+
+	fromIndex, err := releaseIndex(ctx, org, repo, from)
+	if err != nil {
+		return err
+	}
+
+	toIndex, err := releaseIndex(ctx, org, repo, to)
+	if err != nil {
+		return err
+	}
+
+	diff := diffIndexes(fromIndex, toIndex)
+	diff.From, diff.To = from, to
+
+	return c.JSON(http.StatusOK, diff)
+}
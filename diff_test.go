@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiffBetweenReleases(t *testing.T) {
+	bundles := map[string][]byte{
+		"/o/r/releases/download/v1.0.0/bundle.7z": sevenZipArchive(t,
+			"game-1.0.0/main.lua", "print('v1')",
+			"game-1.0.0/assets/logo.png", "logo",
+			"game-1.0.0/old.lua", "return {}",
+		),
+		"/o/r/releases/download/v1.1.0/bundle.7z": sevenZipArchive(t,
+			"game-1.1.0/main.lua", "print('v1.1')",
+			"game-1.1.0/assets/logo.png", "logo",
+			"game-1.1.0/new.lua", "return 1",
+		),
+	}
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle, ok := bundles[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	want := BundleDiff{
+		From:    "1.0.0",
+		To:      "1.1.0",
+		Added:   []BundleEntry{{Name: "new.lua", Size: 8, Hash: contentHash([]byte("return 1"))}},
+		Removed: []BundleEntry{{Name: "old.lua", Size: 9, Hash: contentHash([]byte("return {}"))}},
+		Changed: []ChangedEntry{{
+			Name:     "main.lua",
+			FromSize: 11,
+			ToSize:   13,
+			FromHash: contentHash([]byte("print('v1')")),
+			ToHash:   contentHash([]byte("print('v1.1')")),
+		}},
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/diff/o/r/1.0.0/1.1.0", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /diff = %d: %s", rec.Code, rec.Body)
+		}
+
+		var got BundleDiff
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode diff: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("diff = %+v, want %+v", got, want)
+		}
+	}
+
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream hits = %d, want each release fetched once", n)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/diff/o/r/1.0.0/not-a-tag", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /diff with an invalid tag = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentDigestMatchesBody(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('digest')", "carimbo.wasm", "\x00asm"+strings.Repeat(" digest", 512))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	get := func(e http.Handler, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/9.279.0/o/r/1.0.0/720p/carimbo.wasm", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if got := get(newServer(), "", "").Header().Get("Content-Digest"); got != "" {
+		t.Errorf("Content-Digest without CONTENT_DIGEST = %q, want none", got)
+	}
+
+	t.Setenv("CONTENT_DIGEST", "true")
+	e := newServer()
+
+	// The digest covers the bytes as sent, encoded or not.
+	for _, encoding := range []string{"", "br"} {
+		rec := get(e, "Accept-Encoding", encoding)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET carimbo.wasm = %d: %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("Accept-Encoding %q served Content-Encoding %q", encoding, got)
+		}
+		sum := sha256.Sum256(rec.Body.Bytes())
+		want := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+		if got := rec.Header().Get("Content-Digest"); got != want {
+			t.Errorf("Accept-Encoding %q Content-Digest = %q, want %q", encoding, got, want)
+		}
+	}
+
+	if got := get(e, "Range", "bytes=0-3").Header().Get("Content-Digest"); got != "" {
+		t.Errorf("Content-Digest on a range request = %q, want none", got)
+	}
+}
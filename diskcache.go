@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type diskMeta struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Fetched time.Time `json:"fetched"`
+
+	// TTL is the CACHE_TTL in force when the entry was fetched, so a
+	// per-route override outlives the request that set it. Zero never
+	// expires.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+type DiskCache struct {
+	dir       string
+	maxBytes  int64
+	minFree   uint64
+	freeSpace func(string) (uint64, error)
+	writers   chan struct{}
+
+	// skipping is set while low disk space is keeping writes out, so the
+	// condition is logged once rather than on every write.
+	skipping atomic.Bool
+}
+
+// disk is set up by newServer from CACHE_DIR; nil means no disk cache.
+var disk *DiskCache
+
+func newDiskCache(dir string) *DiskCache {
+	if dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("disk cache disabled", "dir", dir, "error", err)
+		return nil
+	}
+
+	d := &DiskCache{
+		dir:       dir,
+		maxBytes:  int64(envInt("DISK_CACHE_MAX_BYTES", 0)),
+		minFree:   uint64(envInt("DISK_CACHE_MIN_FREE", 0)),
+		freeSpace: freeDiskSpace,
+		writers:   make(chan struct{}, max(envInt("DISK_WRITE_CONCURRENCY", 2), 1)),
+	}
+	// File times come from a coarse clock that can lag time.Now, so leave a
+	// margin for writes that start right after this.
+	go d.scrub(time.Now().Add(-time.Second))
+	return d
+}
+
+type skipDiskKey struct{}
+
+func withoutDiskCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipDiskKey{}, true)
+}
+
+func useDiskCache(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipDiskKey{}).(bool)
+	return disk != nil && !skip
+}
+
+func diskName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DiskCache) paths(key string) (string, string) {
+	name := filepath.Join(d.dir, diskName(key))
+	return name, name + ".json"
+}
+
+func (d *DiskCache) readMeta(path string) (diskMeta, error) {
+	meta := diskMeta{}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, fmt.Errorf("parse meta error: %w", err)
+	}
+	return meta, nil
+}
+
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	dataPath, metaPath := d.paths(key)
+
+	meta, err := d.readMeta(metaPath)
+	if err != nil {
+		return nil, false
+	}
+
+	if meta.TTL > 0 && time.Since(meta.Fetched) >= meta.TTL {
+		d.Remove(key)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(dataPath)
+	if err != nil || int64(len(data)) != meta.Size {
+		return nil, false
+	}
+
+	// The data file's mtime doubles as its last use for LRU eviction.
+	now := time.Now()
+	if err := os.Chtimes(dataPath, now, now); err != nil {
+		slog.Warn("touch disk cache entry failed", "key", key, "error", err)
+	}
+
+	return data, true
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp error: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp error: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *DiskCache) lowOnSpace() bool {
+	if d.minFree == 0 {
+		return false
+	}
+
+	free, err := d.freeSpace(d.dir)
+	if err != nil {
+		slog.Warn("disk space check failed", "dir", d.dir, "error", err)
+		return false
+	}
+	return free < d.minFree
+}
+
+// writable reports whether writes are let in, logging once when low disk
+// space starts and stops keeping them out.
+func (d *DiskCache) writable() bool {
+	if d.lowOnSpace() {
+		if !d.skipping.Swap(true) {
+			slog.Warn("low disk space, skipping disk cache writes", "dir", d.dir, "min_free", d.minFree)
+		}
+		d.evictUntilFree()
+		return false
+	}
+	if d.skipping.Swap(false) {
+		slog.Info("disk space recovered, resuming disk cache writes", "dir", d.dir)
+	}
+	return true
+}
+
+func (d *DiskCache) Put(key string, data []byte, ttl time.Duration) error {
+	w, err := d.create(key, ttl)
+	if err != nil || w == nil {
+		return err
+	}
+
+	d.writers <- struct{}{}
+	defer func() { <-d.writers }()
+
+	w.Write(data)
+	return w.commit()
+}
+
+// diskWriter stages an entry in a temp file, so a download reaches disk in
+// the same pass it is read from upstream. Nothing is visible to Get until
+// commit, which the caller runs once the whole body has been validated.
+type diskWriter struct {
+	d    *DiskCache
+	key  string
+	ttl  time.Duration
+	tmp  *os.File
+	hash hash.Hash
+	size int64
+	err  error
+}
+
+// create returns nil, and no error, while low disk space keeps writes out.
+func (d *DiskCache) create(key string, ttl time.Duration) (*diskWriter, error) {
+	if !d.writable() {
+		return nil, nil
+	}
+
+	dataPath, _ := d.paths(key)
+	tmp, err := os.CreateTemp(d.dir, filepath.Base(dataPath)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp error: %w", err)
+	}
+	return &diskWriter{d: d, key: key, ttl: ttl, tmp: tmp, hash: sha256.New()}, nil
+}
+
+// Write never fails, so a disk problem can't fail the download it is teed
+// from; the first error is returned by commit instead.
+func (w *diskWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		if _, err := w.tmp.Write(p); err != nil {
+			w.err = fmt.Errorf("write temp error: %w", err)
+		}
+		w.hash.Write(p)
+		w.size += int64(len(p))
+	}
+	return len(p), nil
+}
+
+func (w *diskWriter) commit() error {
+	defer os.Remove(w.tmp.Name())
+
+	if err := w.tmp.Close(); err != nil && w.err == nil {
+		w.err = fmt.Errorf("close temp error: %w", err)
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	dataPath, metaPath := w.d.paths(w.key)
+	meta, err := json.Marshal(diskMeta{Key: w.key, Size: w.size, SHA256: hex.EncodeToString(w.hash.Sum(nil)), Fetched: time.Now(), TTL: w.ttl})
+	if err != nil {
+		return fmt.Errorf("encode meta error: %w", err)
+	}
+
+	if err := os.Rename(w.tmp.Name(), dataPath); err != nil {
+		return fmt.Errorf("rename temp error: %w", err)
+	}
+	if err := writeAtomic(metaPath, meta); err != nil {
+		return err
+	}
+
+	w.d.evictOverSize()
+	return nil
+}
+
+func (w *diskWriter) abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (d *DiskCache) Remove(key string) {
+	dataPath, metaPath := d.paths(key)
+	os.Remove(metaPath)
+	os.Remove(dataPath)
+}
+
+func (d *DiskCache) entries() ([]diskMeta, error) {
+	matches, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]diskMeta, 0, len(matches))
+	for _, path := range matches {
+		if meta, err := d.readMeta(path); err == nil && strings.TrimSuffix(filepath.Base(path), ".json") == diskName(meta.Key) {
+			metas = append(metas, meta)
+		}
+	}
+	return metas, nil
+}
+
+func (d *DiskCache) evictUntilFree() {
+	metas, err := d.entries()
+	if err != nil {
+		slog.Warn("list disk cache failed", "dir", d.dir, "error", err)
+		return
+	}
+
+	for _, meta := range d.leastRecent(metas) {
+		if !d.lowOnSpace() {
+			return
+		}
+		slog.Info("evicting disk cache entry", "key", meta.Key, "size", meta.Size, "reason", "disk space")
+		d.Remove(meta.Key)
+	}
+}
+
+// leastRecent orders entries by last use, oldest first, falling back to the
+// fetch time when the data file can't be stat'ed.
+func (d *DiskCache) leastRecent(metas []diskMeta) []diskMeta {
+	used := make(map[string]time.Time, len(metas))
+	for _, meta := range metas {
+		used[meta.Key] = meta.Fetched
+		if info, err := os.Stat(filepath.Join(d.dir, diskName(meta.Key))); err == nil {
+			used[meta.Key] = info.ModTime()
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool { return used[metas[i].Key].Before(used[metas[j].Key]) })
+	return metas
+}
+
+// evictOverSize drops least recently used entries until the cache fits
+// DISK_CACHE_MAX_BYTES.
+func (d *DiskCache) evictOverSize() {
+	if d.maxBytes <= 0 {
+		return
+	}
+
+	metas, err := d.entries()
+	if err != nil {
+		slog.Warn("list disk cache failed", "dir", d.dir, "error", err)
+		return
+	}
+
+	var total int64
+	for _, meta := range metas {
+		total += meta.Size
+	}
+
+	for _, meta := range d.leastRecent(metas) {
+		if total <= d.maxBytes {
+			return
+		}
+		slog.Info("evicting disk cache entry", "key", meta.Key, "size", meta.Size, "reason", "max size")
+		d.Remove(meta.Key)
+		total -= meta.Size
+	}
+}
+
+func (d *DiskCache) valid(meta diskMeta) bool {
+	data, err := os.ReadFile(filepath.Join(d.dir, diskName(meta.Key)))
+	if err != nil || int64(len(data)) != meta.Size {
+		return false
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == meta.SHA256
+}
+
+// scrub removes whatever an unclean shutdown may have left behind: temp files
+// from interrupted writes, data without metadata, and entries whose content
+// no longer matches the recorded size and hash. It runs alongside live
+// traffic, so files modified since before are left to the writes that own
+// them.
+func (d *DiskCache) scrub(before time.Time) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		slog.Warn("scan disk cache failed", "dir", d.dir, "error", err)
+		return
+	}
+
+	keep := map[string]bool{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		meta, err := d.readMeta(filepath.Join(d.dir, name))
+		if err == nil && strings.TrimSuffix(name, ".json") == diskName(meta.Key) && d.valid(meta) {
+			keep[name] = true
+			keep[strings.TrimSuffix(name, ".json")] = true
+		}
+	}
+
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || keep[file.Name()] {
+			continue
+		}
+		if info, err := file.Info(); err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.dir, file.Name())); err == nil {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		slog.Info("removed invalid disk cache files", "dir", d.dir, "count", removed)
+	}
+}
+
+// audit re-hashes every entry and evicts those whose content no longer
+// matches the recorded metadata.
+func (d *DiskCache) audit() {
+	metas, err := d.entries()
+	if err != nil {
+		slog.Warn("list disk cache failed", "dir", d.dir, "error", err)
+		return
+	}
+
+	for _, meta := range metas {
+		if !d.valid(meta) {
+			slog.Error("corrupt disk cache entry, evicting", "key", meta.Key, "size", meta.Size, "sha256", meta.SHA256)
+			d.Remove(meta.Key)
+		}
+	}
+}
+
+func (d *DiskCache) startAudit(interval time.Duration) {
+	if d == nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			d.audit()
+		}
+	}()
+}
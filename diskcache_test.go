@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheSkipsWritesWhenLowOnSpace(t *testing.T) {
+	logs := captureLogs(t)
+
+	var free atomic.Uint64
+	free.Store(1 << 30)
+	d := newDiskCache(t.TempDir())
+	d.minFree = 1 << 20
+	d.freeSpace = func(string) (uint64, error) { return free.Load(), nil }
+
+	if err := d.Put("old", []byte("old entry"), 0); err != nil {
+		t.Fatalf("put old: %v", err)
+	}
+
+	free.Store(1 << 10)
+	for _, key := range []string{"new", "newer"} {
+		if err := d.Put(key, []byte("skipped"), 0); err != nil {
+			t.Fatalf("put %s while low on space: %v", key, err)
+		}
+		if _, ok := d.Get(key); ok {
+			t.Errorf("%s was cached while low on space", key)
+		}
+	}
+	if _, ok := d.Get("old"); ok {
+		t.Error("old entry survived the low space eviction")
+	}
+	if n := strings.Count(logs.String(), "low disk space"); n != 1 {
+		t.Errorf("low disk space logged %d times, want once per episode:\n%s", n, logs)
+	}
+
+	free.Store(1 << 30)
+	if err := d.Put("later", []byte("later entry"), 0); err != nil {
+		t.Fatalf("put later: %v", err)
+	}
+	if data, ok := d.Get("later"); !ok || string(data) != "later entry" {
+		t.Errorf("Get(later) = %q %t after space recovered, want the entry", data, ok)
+	}
+	if !strings.Contains(logs.String(), "disk space recovered") {
+		t.Error("recovery was not logged")
+	}
+}
+
+func TestDiskCacheConcurrentWrites(t *testing.T) {
+	t.Setenv("DISK_WRITE_CONCURRENCY", "2")
+	d := newDiskCache(t.TempDir())
+
+	content := func(key string, i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s-%02d;", key, i)), 4096)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		for _, key := range []string{"shared", fmt.Sprintf("own-%d", i)} {
+			wg.Add(1)
+			go func(key string, i int) {
+				defer wg.Done()
+				if err := d.Put(key, content(key, i), 0); err != nil {
+					t.Errorf("put %s: %v", key, err)
+				}
+			}(key, i)
+		}
+	}
+	wg.Wait()
+
+	data, ok := d.Get("shared")
+	if !ok {
+		t.Fatal("shared entry missing after concurrent writes")
+	}
+	whole := false
+	for i := 0; i < 16; i++ {
+		if bytes.Equal(data, content("shared", i)) {
+			whole = true
+		}
+	}
+	if !whole {
+		t.Error("shared entry is a mix of concurrent writes")
+	}
+
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("own-%d", i)
+		if data, ok := d.Get(key); !ok || !bytes.Equal(data, content(key, i)) {
+			t.Errorf("%s = %d bytes %t, want its own content", key, len(data), ok)
+		}
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(d.dir, "*.tmp"))
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestDiskCacheScrubRemovesPartialEntries(t *testing.T) {
+	dir := t.TempDir()
+	seed := &DiskCache{dir: dir, writers: make(chan struct{}, 1)}
+	for _, key := range []string{"valid", "corrupt", "truncated"} {
+		if err := seed.Put(key, []byte("entry "+key), 0); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	corruptData, _ := seed.paths("corrupt")
+	if err := os.WriteFile(corruptData, []byte("entry CORRUPT"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	truncatedData, _ := seed.paths("truncated")
+	if err := os.WriteFile(truncatedData, []byte("entry"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, diskName("orphan"))
+	temp := filepath.Join(dir, diskName("interrupted")+".123.tmp")
+	for _, path := range []string{orphan, temp} {
+		if err := os.WriteFile(path, []byte("left behind"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything predates the restart; a file written since is a live write.
+	old := time.Now().Add(-time.Hour)
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		os.Chtimes(filepath.Join(dir, f.Name()), old, old)
+	}
+	live := filepath.Join(dir, diskName("live")+".456.tmp")
+	if err := os.WriteFile(live, []byte("in progress"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &DiskCache{dir: dir, writers: make(chan struct{}, 1)}
+	d.scrub(time.Now().Add(-time.Minute))
+
+	if data, ok := d.Get("valid"); !ok || string(data) != "entry valid" {
+		t.Errorf("valid entry = %q %t after the scrub, want it kept", data, ok)
+	}
+	for _, key := range []string{"corrupt", "truncated"} {
+		data, meta := d.paths(key)
+		for _, path := range []string{data, meta} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s entry file %s survived the scrub", key, filepath.Base(path))
+			}
+		}
+	}
+	for _, path := range []string{orphan, temp} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s survived the scrub", filepath.Base(path))
+		}
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("scrub removed a temp file written after it started: %v", err)
+	}
+}
+
+func TestDiskCacheAuditEvictsCorruptedEntries(t *testing.T) {
+	logs := captureLogs(t)
+	d := &DiskCache{dir: t.TempDir(), writers: make(chan struct{}, 1)}
+	for _, key := range []string{"intact", "rotten"} {
+		if err := d.Put(key, []byte("cached "+key), 0); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	// Same size, different bytes: only the hash gives it away.
+	data, _ := d.paths("rotten")
+	if err := os.WriteFile(data, []byte("cached R0tten"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d.audit()
+
+	if got, ok := d.Get("intact"); !ok || string(got) != "cached intact" {
+		t.Errorf("intact entry = %q %t after the audit, want it kept", got, ok)
+	}
+	if _, ok := d.Get("rotten"); ok {
+		t.Error("corrupted entry survived the audit")
+	}
+	if _, err := os.Stat(data); !os.IsNotExist(err) {
+		t.Errorf("corrupted entry's file is still on disk: %v", err)
+	}
+	if !strings.Contains(logs.String(), "corrupt disk cache entry") || !strings.Contains(logs.String(), "key=rotten") {
+		t.Errorf("audit did not log the corruption:\n%s", logs)
+	}
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("DISK_CACHE_MAX_BYTES", "20")
+	d := newDiskCache(t.TempDir())
+
+	old := time.Now().Add(-time.Hour)
+	for i, key := range []string{"a", "b"} {
+		if err := d.Put(key, []byte("0123456789"), 0); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		dataPath, _ := d.paths(key)
+		stamp := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(dataPath, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading a refreshes its last use, so b is now the oldest.
+	if _, ok := d.Get("a"); !ok {
+		t.Fatal("a missing before the cache was full")
+	}
+	if err := d.Put("c", []byte("0123456789"), 0); err != nil {
+		t.Fatalf("put c: %v", err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := d.Get(key); ok != want {
+			t.Errorf("Get(%s) cached = %t, want %t", key, ok, want)
+		}
+	}
+}
+
+func TestDiskCacheExpiresPastTTL(t *testing.T) {
+	// Each entry keeps the TTL it was written with; the global one is not
+	// consulted on read.
+	t.Setenv("CACHE_TTL", "1ns")
+	d := newDiskCache(t.TempDir())
+
+	if err := d.Put("fresh", []byte("fresh"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("short", []byte("short"), time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.Get("fresh"); !ok {
+		t.Error("entry within its own TTL was not served")
+	}
+	if _, ok := d.Get("short"); ok {
+		t.Error("entry past its own TTL was served")
+	}
+	dataPath, metaPath := d.paths("short")
+	for _, path := range []string{dataPath, metaPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left on disk after expiry: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestDiskCacheKeepsCacheTTLOverride(t *testing.T) {
+	t.Setenv("CACHE_TTL", "1h")
+	disk = newDiskCache(t.TempDir())
+	t.Cleanup(func() { disk = nil })
+
+	stage := stageDisk(withCacheTTL(context.Background(), time.Nanosecond), "http://upstream/override")
+	stage.Write([]byte("override"))
+	if err := stage.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, metaPath := disk.paths("http://upstream/override")
+	meta, err := disk.readMeta(metaPath)
+	if err != nil || meta.TTL != time.Nanosecond {
+		t.Fatalf("meta TTL = %v (%v), want the 1ns override", meta.TTL, err)
+	}
+	if _, ok := disk.Get("http://upstream/override"); ok {
+		t.Error("entry fetched under a 1ns override was served past it")
+	}
+}
+
+func TestBundleSurvivesRestartOnDisk(t *testing.T) {
+	bundle := sevenZipArchive(t, "main.lua", "print('disk')")
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/o/diskrestart/releases/download/v1.0.0/bundle.7z" {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("CACHE_DIR", t.TempDir())
+	t.Cleanup(func() { disk = nil })
+
+	for i := 0; i < 2; i++ {
+		// A fresh server with an empty memory cache stands in for a restart.
+		cache.bundles.purge(bundleURL("o", "diskrestart", "1.0.0"))
+		e := newServer()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.501.0/o/diskrestart/1.0.0/720p/bundle.7z", nil))
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), bundle) {
+			t.Fatalf("start %d: GET bundle = %d, %d bytes", i, rec.Code, rec.Body.Len())
+		}
+	}
+
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream fetched the bundle %d times across a restart, want 1", n)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+var errNoDiskSpaceInfo = errors.New("disk space information unavailable")
+
+func freeDiskSpace(string) (uint64, error) {
+	return 0, errNoDiskSpaceInfo
+}
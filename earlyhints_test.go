@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEarlyHintsPrecedeTheIndexPage(t *testing.T) {
+	for _, tc := range []struct {
+		enabled, encoding string
+		want              bool
+	}{
+		{"", "", false},
+		{"true", "", true},
+		// Accepting gzip puts the gzip middleware's writer in front.
+		{"true", "gzip", true},
+	} {
+		t.Setenv("EARLY_HINTS", tc.enabled)
+		srv := httptest.NewServer(newServer())
+
+		var (
+			mu      sync.Mutex
+			events  []string
+			preload []string
+		)
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if code == http.StatusEarlyHints {
+					events = append(events, "103")
+					preload = header.Values("Link")
+				}
+				return nil
+			},
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/9.270.0/o/r/1.0.0/720p", nil)
+		if tc.encoding != "" {
+			req.Header.Set("Accept-Encoding", tc.encoding)
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			srv.Close()
+			t.Fatalf("GET index: %v", err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		mu.Lock()
+		events = append(events, resp.Status)
+		mu.Unlock()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("EARLY_HINTS=%q GET index = %d, want 200", tc.enabled, resp.StatusCode)
+		}
+
+		mu.Lock()
+		got := strings.Join(events, ", ")
+		links := strings.Join(preload, ", ")
+		mu.Unlock()
+
+		if !tc.want {
+			if strings.Contains(got, "103") {
+				t.Errorf("EARLY_HINTS=%q sent a 103", tc.enabled)
+			}
+			continue
+		}
+		if !strings.HasPrefix(got, "103") {
+			t.Errorf("EARLY_HINTS=%q Accept-Encoding=%q response events = %s, want the 103 before the final response", tc.enabled, tc.encoding, got)
+		}
+		for _, want := range []string{"</9.270.0/o/r/1.0.0/720p/carimbo.js>; rel=preload; as=script", "</9.270.0/o/r/1.0.0/720p/carimbo.wasm>; rel=preload"} {
+			if !strings.Contains(links, want) {
+				t.Errorf("103 Link headers %q do not preload %s", links, want)
+			}
+		}
+	}
+}
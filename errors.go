@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type unavailableCause string
+
+const (
+	causeUpstream    unavailableCause = "upstream"
+	causeOverload    unavailableCause = "overload"
+	causeMaintenance unavailableCause = "maintenance"
+)
+
+var retryAfterDefaults = map[unavailableCause]time.Duration{
+	causeUpstream:    30 * time.Second,
+	causeOverload:    5 * time.Second,
+	causeMaintenance: 5 * time.Minute,
+}
+
+type unavailableError struct {
+	cause unavailableCause
+	err   error
+}
+
+func (e *unavailableError) Error() string {
+	if e.err == nil {
+		return string(e.cause)
+	}
+	return fmt.Sprintf("%s: %v", e.cause, e.err)
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func serviceUnavailable(cause unavailableCause, message string, err error) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusServiceUnavailable, message).SetInternal(&unavailableError{cause: cause, err: err})
+}
+
+func retryAfter(err error) time.Duration {
+	cause := causeUpstream
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		cause = ue.cause
+	}
+	return envDuration("RETRY_AFTER_"+strings.ToUpper(string(cause)), retryAfterDefaults[cause])
+}
+
+// upstreamMissing reports a version upstream confirmed doesn't exist, the
+// only kind of 404 worth letting shared caches keep for NOT_FOUND_TTL.
+func upstreamMissing(err error) bool {
+	var nf *notFoundError
+	return errors.As(err, &nf) && errors.Is(nf, errUpstreamNotFound)
+}
+
+type errorResponse struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	code := http.StatusInternalServerError
+	message := http.StatusText(code)
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		code = he.Code
+		if m, ok := he.Message.(string); ok {
+			message = m
+		} else {
+			message = http.StatusText(code)
+		}
+	}
+
+	if envBool("VERBOSE_ERRORS", false) {
+		message = err.Error()
+	}
+
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if code >= http.StatusInternalServerError {
+		slog.Error("request failed", "request_id", id, "status", code, "path", c.Request().URL.Path, "error", err)
+		failures.record(failure{Time: time.Now(), Status: code, Path: c.Request().URL.Path, RequestID: id, Error: err.Error()})
+	}
+
+	header := c.Response().Header()
+	header.Del("Expires")
+	if ttl := envDuration("NOT_FOUND_TTL", time.Minute); code == http.StatusNotFound && ttl > 0 && upstreamMissing(err) {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+	} else {
+		header.Set("Cache-Control", "no-store")
+	}
+
+	if code == http.StatusServiceUnavailable {
+		header.Set("Retry-After", strconv.Itoa(int(retryAfter(err).Seconds())))
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = c.JSON(code, errorResponse{Message: message, RequestID: id})
+	}
+	if err != nil {
+		slog.Error("write error response failed", "request_id", id, "error", err)
+	}
+}
+
+type failure struct {
+	Time      time.Time
+	Status    int
+	Path      string
+	RequestID string
+	Error     string
+}
+
+// failureLog keeps the last few server errors in memory for the status page.
+type failureLog struct {
+	mu      sync.Mutex
+	entries []failure
+	limit   int
+}
+
+var failures = &failureLog{limit: 20}
+
+func (l *failureLog) record(f failure) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, f)
+	if len(l.entries) > l.limit {
+		l.entries = l.entries[len(l.entries)-l.limit:]
+	}
+}
+
+func (l *failureLog) recent() []failure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]failure, len(l.entries))
+	for i, f := range l.entries {
+		out[len(out)-1-i] = f
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestErrorCacheControl(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.GET("/boom", func(c echo.Context) error { return errors.New("boom") })
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("GET /boom = %d, want 500", rec.Code)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("500 Cache-Control = %q, want no-store", got)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+	if got := rec.Header().Get("Cache-Control"); rec.Code != http.StatusNotFound || got != "no-store" {
+		t.Errorf("route 404 = %d Cache-Control %q, want 404 no-store", rec.Code, got)
+	}
+}
+
+func TestUpstreamNotFoundIsCachedBriefly(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("NOT_FOUND_TTL", "30s")
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.221.0/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("GET carimbo.js of a missing runtime = %d, want 404: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=30" {
+		t.Errorf("upstream 404 Cache-Control = %q, want public, max-age=30", got)
+	}
+}
+
+func TestUpstreamErrorsAreRedacted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("definitely not a zip"))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+
+	for _, verbose := range []bool{false, true} {
+		logs := captureLogs(t)
+		t.Setenv("VERBOSE_ERRORS", strconv.FormatBool(verbose))
+		e := newServer()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.223.0/o/r/1.0.0/720p/carimbo.js", nil))
+		if rec.Code < http.StatusInternalServerError {
+			t.Fatalf("GET carimbo.js of a broken runtime = %d, want a 5xx", rec.Code)
+		}
+
+		var body errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		id := rec.Header().Get(echo.HeaderXRequestID)
+		if id == "" || body.RequestID != id {
+			t.Errorf("error body request_id = %q, want the X-Request-Id %q", body.RequestID, id)
+		}
+
+		leaked := strings.Contains(body.Message, "zip")
+		if leaked != verbose {
+			t.Errorf("VERBOSE_ERRORS=%t message = %q", verbose, body.Message)
+		}
+
+		out := logs.String()
+		if !strings.Contains(out, "request_id="+id) || !strings.Contains(out, "zip") {
+			t.Errorf("log lacks the request ID or the error detail:\n%s", out)
+		}
+	}
+}
+
+func TestRetryAfterByCause(t *testing.T) {
+	t.Setenv("RETRY_AFTER_OVERLOAD", "2s")
+
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	for _, cause := range []unavailableCause{causeUpstream, causeOverload, causeMaintenance} {
+		cause := cause
+		e.GET("/"+string(cause), func(c echo.Context) error {
+			return serviceUnavailable(cause, "unavailable", errors.New("boom"))
+		})
+	}
+	e.GET("/wrapped", func(c echo.Context) error {
+		return fmt.Errorf("fetch error: %w", serviceUnavailable(causeMaintenance, "unavailable", nil))
+	})
+
+	for path, want := range map[string]string{
+		"/upstream":    "30",
+		"/overload":    "2",
+		"/maintenance": "300",
+		"/wrapped":     "300",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("GET %s = %d, want 503", path, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("GET %s Retry-After = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// etagValue quotes an opaque tag, as the entity-tag syntax requires.
+func etagValue(tag string) string {
+	return `"` + tag + `"`
+}
+
+// etagMatch reports whether an If-None-Match header matches etag. It uses the
+// weak comparison RFC 9110 prescribes for If-None-Match: W/ prefixes are
+// ignored, the header may list several tags, and * matches any.
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets tag as the response's ETag and reports whether the
+// request's If-None-Match already holds it, so a 304 will do.
+func notModified(c echo.Context, tag string) bool {
+	etag := etagValue(tag)
+	c.Response().Header().Set("ETag", etag)
+
+	header := c.Request().Header.Get("If-None-Match")
+	return header != "" && etagMatch(header, etag)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestETagMatch(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`"x",W/"abc"`, true},
+		{`*`, true},
+		{`"abcd"`, false},
+		{`abc`, false},
+		{`"x", "y"`, false},
+	} {
+		if got := etagMatch(tc.header, `"abc"`); got != tc.want {
+			t.Errorf("etagMatch(%s, \"abc\") = %t, want %t", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestETagsAreQuotedAndRevalidate(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('etag')", "carimbo.wasm", "\x00asm etag")
+	bundle := sevenZipArchive(t, "main.lua", "print('etag')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/bundle.7z") {
+			w.Write(bundle)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	resetState(t)
+	e := newServer()
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, name := range []string{"", "/carimbo.js", "/carimbo.wasm", "/bundle.7z", "/contents.json", "/bundle.tar.gz", "/files/main.lua"} {
+		path := "/9.254.0/o/etag/1.0.0/720p" + name
+		rec := get(path, "")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+			t.Errorf("GET %s = %d with ETag %s, want a 200 with a quoted ETag", path, rec.Code, etag)
+			continue
+		}
+
+		for _, header := range []string{etag, "W/" + etag, `"other", ` + etag} {
+			if rec := get(path, header); rec.Code != http.StatusNotModified {
+				t.Errorf("GET %s with If-None-Match: %s = %d, want 304", path, header, rec.Code)
+			}
+		}
+		if rec := get(path, `"other"`); rec.Code != http.StatusOK {
+			t.Errorf("GET %s with a different If-None-Match = %d, want 200", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+const noWasmHeader = "X-No-Wasm"
+
+//go:embed fallback.html
+var defaultFallback []byte
+
+func noWasm(c echo.Context) bool {
+	return c.QueryParam("nowasm") != "" || c.Request().Header.Get(noWasmHeader) != ""
+}
+
+func fallbackHandler(c echo.Context) error {
+	if url := envString("FALLBACK_URL", ""); url != "" {
+		return c.Redirect(http.StatusFound, url)
+	}
+
+	content := defaultFallback
+	if path := envString("FALLBACK_HTML", ""); path != "" {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("read fallback error: %w", err)
+		}
+	}
+
+	return c.HTMLBlob(http.StatusOK, content)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNoWasmServesFallback(t *testing.T) {
+	e := newServer()
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		set   func(*http.Request)
+	}{
+		{"query", "?nowasm=1", func(*http.Request) {}},
+		{"header", "", func(r *http.Request) { r.Header.Set(noWasmHeader, "1") }},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/9.242.0/o/r/1.0.0/720p"+tc.query, nil)
+		tc.set(req)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), defaultFallback) {
+			t.Errorf("%s no-wasm signal = %d, want the fallback page", tc.name, rec.Code)
+		}
+		if vary := strings.Join(rec.Header().Values("Vary"), ", "); !strings.Contains(vary, noWasmHeader) {
+			t.Errorf("%s Vary = %q, want %s", tc.name, vary, noWasmHeader)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.242.0/o/r/1.0.0/720p", nil))
+	if bytes.Equal(rec.Body.Bytes(), defaultFallback) {
+		t.Error("index without a no-wasm signal served the fallback")
+	}
+}
+
+func TestNoWasmFallbackConfiguration(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "fallback.html")
+	if err := os.WriteFile(page, []byte("<p>upgrade your browser</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FALLBACK_HTML", page)
+
+	rec := httptest.NewRecorder()
+	newServer().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.242.0/o/r/1.0.0/720p?nowasm=1", nil))
+	if got := rec.Body.String(); got != "<p>upgrade your browser</p>" {
+		t.Errorf("FALLBACK_HTML page = %q", got)
+	}
+
+	t.Setenv("FALLBACK_URL", "https://example.com/unsupported")
+	rec = httptest.NewRecorder()
+	newServer().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.242.0/o/r/1.0.0/720p?nowasm=1", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://example.com/unsupported" {
+		t.Errorf("FALLBACK_URL = %d to %q, want a 302 to it", rec.Code, rec.Header().Get("Location"))
+	}
+}
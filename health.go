@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type probeResult struct {
+	err     error
+	expires time.Time
+}
+
+var (
+	readyMu   sync.Mutex
+	readyLast probeResult
+)
+
+func probeUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, envDuration("READY_TIMEOUT", 2*time.Second))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, envString("READY_PROBE_URL", "https://github.com"), nil)
+	if err != nil {
+		return fmt.Errorf("http request error: %w", err)
+	}
+
+	resp, err := upstream.Do(req)
+	if err != nil {
+		return fmt.Errorf("http head error: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream status: %s", resp.Status)
+	}
+	return nil
+}
+
+func readiness(ctx context.Context) error {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+
+	if time.Now().Before(readyLast.expires) {
+		return readyLast.err
+	}
+
+	err := probeUpstream(ctx)
+	readyLast = probeResult{err: err, expires: time.Now().Add(envDuration("READY_CACHE_TTL", 10*time.Second))}
+	return err
+}
+
+func readyHandler(c echo.Context) error {
+	if err := readiness(c.Request().Context()); err != nil {
+		return serviceUnavailable(causeUpstream, "upstream unavailable", err)
+	}
+
+	return c.String(http.StatusOK, "ok")
+}
+
+func healthHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func resetReadiness(t *testing.T) {
+	t.Helper()
+
+	readyMu.Lock()
+	readyLast = probeResult{}
+	readyMu.Unlock()
+	t.Cleanup(func() {
+		readyMu.Lock()
+		readyLast = probeResult{}
+		readyMu.Unlock()
+	})
+}
+
+func TestReadyTimesOutOnSlowUpstream(t *testing.T) {
+	var hits atomic.Int64
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer probe.Close()
+
+	resetReadiness(t)
+	t.Setenv("READY_PROBE_URL", probe.URL)
+	t.Setenv("READY_TIMEOUT", "50ms")
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	e := newServer()
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /ready = %d, want 503", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("GET /ready took %v against a 50ms READY_TIMEOUT", elapsed)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("second GET /ready = %d, want the cached 503", rec.Code)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("probe hit upstream %d times, want 1 within READY_CACHE_TTL", n)
+	}
+}
+
+func TestReadyOnHealthyUpstream(t *testing.T) {
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer probe.Close()
+
+	resetReadiness(t)
+	t.Setenv("READY_PROBE_URL", probe.URL)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /ready = %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
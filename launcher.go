@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/labstack/echo/v4"
+)
+
+var launcherTemplate = template.Must(template.New("launcher").Parse(`(() => {
+  const script = {{ .Script }};
+  const binary = {{ .Binary }};
+  const bundle = {{ .Bundle }};
+
+  const canvas = document.currentScript?.dataset.canvas
+    ? document.querySelector(document.currentScript.dataset.canvas)
+    : document.getElementById("canvas");
+
+  window.Module = {
+    canvas,
+    noInitialRun: true,
+    locateFile: (path) => (path.endsWith(".wasm") ? binary : path),
+    onRuntimeInitialized: () => {
+      fetch(bundle)
+        .then((response) => response.arrayBuffer())
+        .then((data) => {
+          FS.writeFile("/bundle.7z", new Uint8Array(data));
+          Module.callMain();
+        });
+    },
+  };
+
+  const loader = document.createElement("script");
+  loader.src = script;
+  document.head.appendChild(loader);
+})();
+`))
+
+func jsString(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+// assetBase is where p's assets are served from: path-absolute, or under
+// PUBLIC_URL when that is set. It never comes from the request's Host or
+// scheme, since the responses embedding it are cached publicly.
+func assetBase(p Params) string {
+	origin := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	prefix := strings.TrimSuffix(os.Getenv("STRIP_PREFIX"), "/")
+	return fmt.Sprintf("%s%s/%s/%s/%s/%s/%s/", origin, prefix, p.Runtime, p.Organization, p.Repository, p.Release, p.Format)
+}
+
+// rewriteWasmURL points the quoted carimbo.wasm literal emitted by the
+// Emscripten loader at our versioned endpoint; nothing else is touched.
+func rewriteWasmURL(script []byte, url string) ([]byte, error) {
+	literal, err := jsString(url)
+	if err != nil {
+		return nil, fmt.Errorf("encode url error: %w", err)
+	}
+
+	for _, quoted := range []string{`"carimbo.wasm"`, `'carimbo.wasm'`} {
+		script = bytes.ReplaceAll(script, []byte(quoted), []byte(literal))
+	}
+	return script, nil
+}
+
+func launcherHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
+
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	base := assetBase(p)
+
+	data := map[string]string{}
+	for key, name := range map[string]string{"Script": "carimbo.js", "Binary": "carimbo.wasm", "Bundle": "bundle.7z"} {
+		literal, err := jsString(base + name)
+		if err != nil {
+			return fmt.Errorf("encode url error: %w", err)
+		}
+		data[key] = literal
+	}
+
+	var buf bytes.Buffer
+	if err := launcherTemplate.Execute(&buf, data); err != nil {
+		return fmt.Errorf("execute template error: %w", err)
+	}
+
+	return c.Blob(http.StatusOK, contentType("launcher.js", nil), buf.Bytes())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLauncherReferencesRequestAssets(t *testing.T) {
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.235.0/o/r/1.0.0/480p/launcher.js", nil)
+	req.Host = "evil.example"
+	req.Header.Set("X-Forwarded-Proto", "gopher")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET launcher.js = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/javascript") {
+		t.Errorf("Content-Type = %q, want application/javascript", got)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`const script = "/9.235.0/o/r/1.0.0/480p/carimbo.js";`,
+		`const binary = "/9.235.0/o/r/1.0.0/480p/carimbo.wasm";`,
+		`const bundle = "/9.235.0/o/r/1.0.0/480p/bundle.7z";`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("launcher.js does not contain %s:\n%s", want, body)
+		}
+	}
+	// launcher.js is cached publicly, so the request's Host must not leak in.
+	if strings.Contains(body, "evil.example") || strings.Contains(body, "gopher") {
+		t.Errorf("launcher.js embeds the spoofed Host or scheme:\n%s", body)
+	}
+}
+
+func TestLauncherUsesPublicURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "https://play.example.com")
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.235.0/o/r/1.0.0/480p/launcher.js", nil)
+	req.Host = "evil.example"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET launcher.js = %d: %s", rec.Code, rec.Body)
+	}
+	if want := `const bundle = "https://play.example.com/9.235.0/o/r/1.0.0/480p/bundle.7z";`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("launcher.js does not contain %s:\n%s", want, rec.Body)
+	}
+}
+
+func TestRewriteWasmURL(t *testing.T) {
+	script := []byte(`var a = "carimbo.wasm"; var b = 'carimbo.wasm'; var c = "carimbo.wasm.map";`)
+
+	got, err := rewriteWasmURL(script, "/1.0.0/o/r/1.0.0/720p/carimbo.wasm")
+	if err != nil {
+		t.Fatalf("rewriteWasmURL: %v", err)
+	}
+
+	want := `var a = "/1.0.0/o/r/1.0.0/720p/carimbo.wasm"; var b = "/1.0.0/o/r/1.0.0/720p/carimbo.wasm"; var c = "carimbo.wasm.map";`
+	if string(got) != want {
+		t.Errorf("rewriteWasmURL = %s, want %s", got, want)
+	}
+}
+
+func TestServedScriptPointsAtVersionedWasmURL(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", `fetch("carimbo.wasm")`, "carimbo.wasm", "\x00asm rewrite")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("REWRITE_WASM_URL", "true")
+
+	for _, tc := range []struct {
+		publicURL, want string
+	}{
+		{"", `fetch("/9.260.0/o/r/1.0.0/720p/carimbo.wasm")`},
+		{"https://play.example.com/", `fetch("https://play.example.com/9.260.0/o/r/1.0.0/720p/carimbo.wasm")`},
+	} {
+		t.Setenv("PUBLIC_URL", tc.publicURL)
+		e := newServer()
+
+		// A forged Host or scheme must not reach a publicly cached body.
+		etags := map[string]bool{}
+		for _, host := range []string{"play.example.com", "evil.example"} {
+			req := httptest.NewRequest(http.MethodGet, "/9.260.0/o/r/1.0.0/720p/carimbo.js", nil)
+			req.Host = host
+			req.Header.Set("X-Forwarded-Proto", "gopher")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET carimbo.js via %s = %d: %s", host, rec.Code, rec.Body)
+			}
+			if rec.Body.String() != tc.want {
+				t.Errorf("PUBLIC_URL=%q carimbo.js via %s = %s, want %s", tc.publicURL, host, rec.Body, tc.want)
+			}
+			etags[rec.Header().Get("ETag")] = true
+		}
+		if len(etags) != 1 {
+			t.Errorf("PUBLIC_URL=%q rewritten script ETag varies by Host: %v", tc.publicURL, etags)
+		}
+	}
+}
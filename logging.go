@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// rotatingFile appends to path and, once maxSize bytes have been written,
+// moves the file aside to path.1 and starts over.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file error: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat log file error: %w", err)
+	}
+
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		r.file.Close()
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return 0, fmt.Errorf("rotate log file error: %w", err)
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func logOutput(sink string, maxSize int64) (io.Writer, error) {
+	switch sink {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	default:
+		return openRotatingFile(sink, maxSize)
+	}
+}
+
+func configureLogging() (io.Writer, error) {
+	w, err := logOutput(os.Getenv("LOG_OUTPUT"), int64(envInt("LOG_MAX_SIZE", 100<<20)))
+	if err != nil {
+		return nil, err
+	}
+
+	var handler slog.Handler
+	switch format := envString("LOG_FORMAT", "text"); format {
+	case "text":
+		handler = slog.NewTextHandler(w, nil)
+	case "json":
+		handler = slog.NewJSONHandler(w, nil)
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT: %s", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return w, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogsGoToConfiguredFile(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	path := filepath.Join(t.TempDir(), "play.log")
+	t.Setenv("LOG_OUTPUT", path)
+	t.Setenv("LOG_FORMAT", "json")
+	if _, err := configureLogging(); err != nil {
+		t.Fatalf("configureLogging: %v", err)
+	}
+
+	slog.Info("request", "path", "/9.265.0/o/r/1.0.0/720p")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("log file holds %q, want one JSON entry: %v", data, err)
+	}
+	if entry["msg"] != "request" || entry["path"] != "/9.265.0/o/r/1.0.0/720p" {
+		t.Errorf("logged %v, want the request entry", entry)
+	}
+}
+
+func TestLogFileRotatesPastMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "play.log")
+	w, err := openRotatingFile(path, 16)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+
+	for _, line := range []string{"first line\n", "second line\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("write %q: %v", line, err)
+		}
+	}
+
+	for name, want := range map[string]string{path + ".1": "first line\n", path: "second line\n"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("%s = %q %v, want %q", filepath.Base(name), got, err, want)
+		}
+	}
+}
+
+func TestInvalidLogSinkFailsAtStartup(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	t.Setenv("LOG_OUTPUT", filepath.Join(t.TempDir(), "missing", "play.log"))
+	if _, err := configureLogging(); err == nil || !strings.Contains(err.Error(), "open log file") {
+		t.Errorf("configureLogging with an unwritable LOG_OUTPUT = %v, want an open error", err)
+	}
+
+	t.Setenv("LOG_OUTPUT", "stderr")
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := configureLogging(); err == nil {
+		t.Error("configureLogging accepted LOG_FORMAT=xml")
+	}
+}
@@ -3,14 +3,21 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,51 +27,132 @@ import (
 )
 
 type Runtime struct {
-	Script []byte
-	Binary []byte
+	Script          []byte
+	Binary          []byte
+	ScriptEncoded   Encoded
+	BinaryEncoded   Encoded
+	ScriptIntegrity string
+	BinaryIntegrity string
+	Hash            string
+	Modified        time.Time
 }
 
+type Bundle struct {
+	Data      []byte
+	Integrity string
+	SHA256    string
+	Hash      string
+	Modified  time.Time
+}
+
+type cacheStatus string
+
+const (
+	cacheHit   cacheStatus = "HIT"
+	cacheMiss  cacheStatus = "MISS"
+	cacheStale cacheStatus = "STALE"
+
+	cacheStatusKey = "cache"
+)
+
 type Cache struct {
-	runtimes sync.Map
-	bundles  sync.Map
+	runtimes *store[Runtime]
+	bundles  *store[Bundle]
+	indexes  *BundleIndexCache
 }
 
 var (
 	//go:embed index.html
-	html []byte
+	html       []byte
+	htmlDigest = sha1.Sum(html)
 	//go:embed assets
 	assets embed.FS
-	cache  Cache
+	cache  = newCache()
 )
 
-func getRuntime(runtime string) (Runtime, error) {
-	url := fmt.Sprintf("https://github.com/flippingpixels/carimbo/releases/download/v%s/WebAssembly.zip", runtime)
+// newCache sizes the in-memory caches from the environment.
+func newCache() Cache {
+	return Cache{
+		runtimes: newStore("runtime",
+			storeLimits{entries: envInt("CACHE_MAX_ENTRIES", 32), bytes: int64(envInt("RUNTIME_CACHE_MAX_BYTES", 0))},
+			func(r Runtime) string { return r.Hash },
+			runtimeSize,
+		),
+		bundles: newStore("bundle",
+			storeLimits{entries: envInt("BUNDLE_CACHE_MAX_ENTRIES", 128), bytes: int64(envInt("BUNDLE_CACHE_MAX_BYTES", 0))},
+			func(b Bundle) string { return b.Hash },
+			func(b Bundle) int64 { return int64(len(b.Data)) },
+		),
+		indexes: newBundleIndexCache(int64(envInt("BUNDLE_INDEX_MAX_BYTES", 256<<20))),
+	}
+}
 
-	if cached, ok := cache.runtimes.Load(runtime); ok {
-		return cached.(Runtime), nil
+func runtimeSize(r Runtime) int64 {
+	size := len(r.Script) + len(r.Binary)
+	for _, encoded := range []Encoded{r.ScriptEncoded, r.BinaryEncoded} {
+		for _, data := range encoded {
+			size += len(data)
+		}
 	}
+	return int64(size)
+}
 
-	client := http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return Runtime{}, fmt.Errorf("http request error: %w", err)
+func setCacheStatus(c echo.Context, status cacheStatus) {
+	c.Set(cacheStatusKey, status)
+	c.Response().Header().Set("X-Cache", string(status))
+	if status == cacheStale {
+		c.Response().Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
+
+func contentHash(parts ...[]byte) string {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
 	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+func getRuntime(ctx context.Context, runtime string) (Runtime, cacheStatus, error) {
+	return cache.runtimes.get(ctx, cacheKey(ctx, runtime), func(ctx context.Context) (Runtime, error) {
+		return fetchRuntime(ctx, runtime)
+	})
+}
 
-	resp, err := client.Do(req)
+func refreshRuntime(ctx context.Context, runtime string) (Runtime, cacheStatus, error) {
+	return cache.runtimes.refresh(ctx, cacheKey(ctx, runtime), func(ctx context.Context) (Runtime, error) {
+		return fetchRuntime(withoutDiskCache(ctx), runtime)
+	})
+}
+
+func fetchRuntime(ctx context.Context, runtime string) (Runtime, error) {
+	url, err := runtimeURL(ctx, runtime)
 	if err != nil {
-		return Runtime{}, fmt.Errorf("http get error: %w", err)
+		return Runtime{}, fmt.Errorf("runtime url error: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	var zr *zip.Reader
+	_, err = download(ctx, url, func(body []byte) error {
+		var err error
+		if zr, err = zip.NewReader(bytes.NewReader(body), int64(len(body))); err != nil {
+			return fmt.Errorf("zip reader error: %w: %w", errCorrupt, err)
+		}
+		return nil
+	})
+	if errors.Is(err, errUpstreamNotFound) {
+		return Runtime{}, &notFoundError{subject: "runtime " + runtime, err: err}
+	}
 	if err != nil {
-		return Runtime{}, fmt.Errorf("read all error: %w", err)
+		return Runtime{}, err
 	}
 
-	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	release, err := acquireRewrite(ctx)
 	if err != nil {
-		return Runtime{}, fmt.Errorf("zip reader error: %w", err)
+		return Runtime{}, err
 	}
+	defer release()
+
+	defer recordTiming(ctx, "rewrite", time.Now())
 
 	readFile := func(file *zip.File) ([]byte, error) {
 		rc, err := file.Open()
@@ -78,6 +166,11 @@ func getRuntime(runtime string) (Runtime, error) {
 
 	var scriptContent, binaryContent []byte
 	for _, file := range zr.File {
+		if err := validEntryName(file.Name, file.NonUTF8); err != nil {
+			slog.Warn("skipping runtime entry", "runtime", runtime, "error", err)
+			continue
+		}
+
 		switch file.Name {
 		case "carimbo.js":
 			scriptContent, err = readFile(file)
@@ -92,38 +185,220 @@ func getRuntime(runtime string) (Runtime, error) {
 		}
 	}
 
-	rt := Runtime{Script: scriptContent, Binary: binaryContent}
-	cache.runtimes.Store(runtime, rt)
-	return rt, nil
+	for name, content := range map[string][]byte{"carimbo.js": scriptContent, "carimbo.wasm": binaryContent} {
+		if content == nil {
+			return Runtime{}, &notFoundError{subject: fmt.Sprintf("%s in runtime %s", name, runtime)}
+		}
+	}
+
+	if !bytes.HasPrefix(binaryContent, wasmMagic) {
+		if disk != nil {
+			disk.Remove(cacheKey(ctx, url))
+		}
+		return Runtime{}, fmt.Errorf("runtime %s: %w: carimbo.wasm is not WebAssembly", runtime, errMalformedRuntime)
+	}
+
+	scriptEncoded, err := precompress(scriptContent)
+	if err != nil {
+		return Runtime{}, fmt.Errorf("precompress script error: %w", err)
+	}
+
+	var binaryEncoded Encoded
+	if !streamWasmCompression() {
+		if binaryEncoded, err = precompress(binaryContent); err != nil {
+			return Runtime{}, fmt.Errorf("precompress binary error: %w", err)
+		}
+	}
+
+	return Runtime{
+		Script:          scriptContent,
+		Binary:          binaryContent,
+		ScriptEncoded:   scriptEncoded,
+		BinaryEncoded:   binaryEncoded,
+		ScriptIntegrity: integrity(scriptContent),
+		BinaryIntegrity: integrity(binaryContent),
+		Hash:            contentHash(scriptContent, binaryContent),
+		Modified:        time.Now(),
+	}, nil
+}
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		size := envInt("COPY_BUFFER_SIZE", 32*1024)
+		if size <= 0 {
+			size = 32 * 1024
+		}
+		buf := make([]byte, size)
+		return &buf
+	},
 }
 
-func getBundle(org, repo, release string) ([]byte, error) {
-	url := fmt.Sprintf("https://github.com/%s/%s/releases/download/v%s/bundle.7z", org, repo, release)
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
 
-	if cached, ok := cache.bundles.Load(url); ok {
-		return cached.([]byte), nil
+	buf := *bp
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+type contextWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w contextWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyContext(w.ctx, w.ResponseWriter, r)
+}
+
+func serveContent(c echo.Context, name, contentType, etag string, modified time.Time, content []byte) error {
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set("ETag", etagValue(etag))
+	setContentDigest(c, content)
+
+	w := contextWriter{ResponseWriter: c.Response(), ctx: c.Request().Context()}
+	http.ServeContent(w, c.Request(), name, modified, bytes.NewReader(content))
+	return nil
+}
+
+func bundleURL(org, repo, release string) string {
+	return currentProvider().assetURL(org, repo, releaseTag(os.Getenv("BUNDLE_TAG_PREFIX"), release), "bundle.7z")
+}
+
+func bundleDownloadURL(ctx context.Context, org, repo, release string) (string, error) {
+	return currentProvider().downloadURL(ctx, org, repo, releaseTag(os.Getenv("BUNDLE_TAG_PREFIX"), release), "bundle.7z")
+}
+
+func getBundle(ctx context.Context, org, repo, release string) (Bundle, cacheStatus, error) {
+	url := bundleURL(org, repo, release)
+	return cache.bundles.get(ctx, cacheKey(ctx, url), func(ctx context.Context) (Bundle, error) {
+		return fetchBundle(ctx, org, repo, release)
+	})
+}
 
-	client := http.DefaultClient
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func refreshBundle(ctx context.Context, org, repo, release string) (Bundle, cacheStatus, error) {
+	url := bundleURL(org, repo, release)
+	return cache.bundles.refresh(ctx, cacheKey(ctx, url), func(ctx context.Context) (Bundle, error) {
+		return fetchBundle(withoutDiskCache(ctx), org, repo, release)
+	})
+}
+
+func fetchBundle(ctx context.Context, org, repo, release string) (Bundle, error) {
+	url, err := bundleDownloadURL(ctx, org, repo, release)
 	if err != nil {
-		return nil, fmt.Errorf("http request error: %w", err)
+		return Bundle{}, fmt.Errorf("bundle url error: %w", err)
 	}
 
-	resp, err := client.Do(req)
+	body, err := download(ctx, url, nil)
+	if errors.Is(err, errUpstreamNotFound) {
+		return Bundle{}, &notFoundError{subject: fmt.Sprintf("bundle %s/%s %s", org, repo, release), err: err}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("http get error: %w", err)
+		return Bundle{}, err
+	}
+
+	sum := sha256.Sum256(body)
+	bundle := Bundle{Data: body, Integrity: integrity(body), SHA256: hex.EncodeToString(sum[:]), Hash: contentHash(body), Modified: time.Now()}
+	casBundles.Store(cacheKey(ctx, bundle.SHA256), cacheKey(ctx, bundleURL(org, repo, release)))
+
+	return bundle, nil
+}
+
+// sendEarlyHints writes a 103 with preload links straight to the net/http
+// writer, since echo treats the first WriteHeader as the final status and the
+// gzip middleware only records the code until the body is written.
+func sendEarlyHints(c echo.Context, base string, files bool) {
+	header := c.Response().Header()
+	header.Add("Link", fmt.Sprintf("<%scarimbo.js>; rel=preload; as=script", base))
+	header.Add("Link", fmt.Sprintf("<%scarimbo.wasm>; rel=preload; as=fetch; crossorigin", base))
+	if files {
+		header.Add("Link", fmt.Sprintf("<%scontents.json>; rel=preload; as=fetch; crossorigin", base))
+	} else {
+		header.Add("Link", fmt.Sprintf("<%sbundle.7z>; rel=preload; as=fetch; crossorigin", base))
+	}
+
+	w := c.Response().Writer
+	for {
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = unwrapper.Unwrap()
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+func indexSource() ([]byte, [sha1.Size]byte) {
+	path := os.Getenv("INDEX_PATH")
+	if path == "" {
+		return html, htmlDigest
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	content, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("read all error: %w", err)
+		slog.Warn("read index failed, using embedded", "path", path, "error", err)
+		return html, htmlDigest
 	}
+	return content, sha1.Sum(content)
+}
 
-	cache.bundles.Store(url, body)
+var formats = map[string]struct {
+	width  int
+	height int
+}{
+	"480p":  {854, 480},
+	"720p":  {1280, 720},
+	"1080p": {1920, 1080},
+}
+
+type indexData struct {
+	BaseURL string
+	Runtime string
+	Nonce   string
+	Width   int
+	Height  int
+	Picker  bool
+	Files   bool
+	Dev     bool
+	Prefix  string
+	Params  Params
+}
+
+// indexETag covers the template and everything injected into it except the
+// nonce, which a revalidated copy keeps from the render it was cached with.
+func indexETag(digest [sha1.Size]byte, data indexData) string {
+	data.Nonce = ""
 
-	return body, nil
+	h := sha1.New()
+	h.Write(digest[:])
+	fmt.Fprintf(h, "%+v", data)
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
 type Params struct {
@@ -134,28 +409,28 @@ type Params struct {
 	Format       string `param:"format"`
 }
 
-func (p *Params) Sha1() string {
-	var sb strings.Builder
-	sb.WriteString(p.Runtime)
-	sb.WriteString(p.Organization)
-	sb.WriteString(p.Repository)
-	sb.WriteString(p.Release)
-
-	triplet := sb.String()
-
-	hash := sha1.New()
-	//nolint:errcheck
-	io.WriteString(hash, triplet)
-	return fmt.Sprintf("%x", hash.Sum(nil))
-}
-
 func indexHandler(c echo.Context) error {
+	c.Response().Header().Add(echo.HeaderVary, noWasmHeader)
+	if noWasm(c) {
+		return fallbackHandler(c)
+	}
+
 	p := Params{}
 	if err := c.Bind(&p); err != nil {
 		return fmt.Errorf("parse parameters error: %w", err)
 	}
 
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+	// Every render carries its own CSP nonce, so shared caches must not hand
+	// one copy to everyone, even when a latest alias asked for alias caching.
+	c.Response().Header().Set("Cache-Control", cachePolicyDirective("page"))
+
+	prefix := strings.TrimSuffix(os.Getenv("STRIP_PREFIX"), "/")
+
 	var sb strings.Builder
+	sb.WriteString(prefix)
 	sb.WriteString("/")
 	sb.WriteString(p.Runtime)
 	sb.WriteString("/")
@@ -168,42 +443,61 @@ func indexHandler(c echo.Context) error {
 	sb.WriteString(p.Format)
 	sb.WriteString("/")
 
-	var formats = map[string]struct {
-		width  int
-		height int
-	}{
-		"480p":  {854, 480},
-		"720p":  {1280, 720},
-		"1080p": {1920, 1080},
-	}
-
 	format, ok := formats[p.Format]
 	if !ok {
 		return fmt.Errorf("invalid format: %s", p.Format)
 	}
 
-	data := struct {
-		BaseURL string
-		Width   int
-		Height  int
-	}{
+	data := indexData{
 		BaseURL: sb.String(),
+		Runtime: p.Runtime,
 		Width:   format.width,
 		Height:  format.height,
+		Picker:  envBool("VERSION_PICKER", false),
+		Files:   envString("BUNDLE_MODE", "archive") == "files",
+		Prefix:  prefix,
+		Params:  p,
 	}
 
-	tmpl, err := template.New("index").Parse(string(html))
+	source, digest := indexSource()
+	etag := indexETag(digest, data)
+	if notModified(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if envBool("EARLY_HINTS", false) && c.Request().Method == http.MethodGet {
+		sendEarlyHints(c, data.BaseURL, data.Files)
+	}
+
+	return renderIndex(c, source, data)
+}
+
+func renderIndex(c echo.Context, source []byte, data indexData) error {
+	nonce, err := newNonce()
 	if err != nil {
-		return fmt.Errorf("parse template error: %w", err)
+		return fmt.Errorf("nonce error: %w", err)
 	}
+	data.Nonce = nonce
 
-	c.Response().Header().Set("Cache-Control", "public, max-age=300, s-maxage=300")
+	tmpl, err := template.New("index").Parse(string(source))
+	if err != nil {
+		return fmt.Errorf("parse template error: %w", err)
+	}
 
-	if err := tmpl.Execute(c.Response().Writer, data); err != nil {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
 		return fmt.Errorf("execute template error: %w", err)
 	}
 
-	return nil
+	c.Response().Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+
+	if c.Request().Method == http.MethodHead {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(buf.Len()))
+		return c.NoContent(http.StatusOK)
+	}
+
+	return c.HTMLBlob(http.StatusOK, buf.Bytes())
 }
 
 func javaScriptHandler(c echo.Context) error {
@@ -212,22 +506,41 @@ func javaScriptHandler(c echo.Context) error {
 		return fmt.Errorf("parse parameters error: %w", err)
 	}
 
-	runtime, err := getRuntime(p.Runtime)
-	if err != nil {
-		return fmt.Errorf("get runtime error: %w", err)
+	if err := resolveParams(c, &p); err != nil {
+		return err
 	}
 
-	etag := p.Sha1()
+	debugUpstreamHeader(c, func() (string, error) { return runtimeURL(c.Request().Context(), p.Runtime) })
 
-	if c.Request().Header.Get("If-None-Match") == etag {
-		return c.NoContent(http.StatusNotModified)
+	runtime, status, err := getRuntime(c.Request().Context(), p.Runtime)
+	if err != nil {
+		return fetchError(fmt.Errorf("get runtime error: %w", err))
 	}
+	setCacheStatus(c, status)
+	defer cache.runtimes.hold(cacheKey(c.Request().Context(), p.Runtime))()
 
-	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, s-maxage=31536000")
-	c.Response().Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	c.Response().Header().Set("ETag", etag)
+	script, encoded, etag, err := runtimeScript(p, runtime)
+	if err != nil {
+		return err
+	}
 
-	return c.Blob(http.StatusOK, "application/javascript", runtime.Script)
+	return blobEncoded(c, contentType("carimbo.js", nil), etag, script, encoded)
+}
+
+// runtimeScript returns carimbo.js as it is served for p, with its ETag. With
+// REWRITE_WASM_URL the body embeds the asset base, which follows PUBLIC_URL,
+// so the ETag does too.
+func runtimeScript(p Params, runtime Runtime) ([]byte, Encoded, string, error) {
+	if !envBool("REWRITE_WASM_URL", false) {
+		return runtime.Script, runtime.ScriptEncoded, runtime.Hash, nil
+	}
+
+	base := assetBase(p)
+	script, err := rewriteWasmURL(runtime.Script, base+"carimbo.wasm")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return script, nil, runtime.Hash + "-" + contentHash([]byte(base)), nil
 }
 
 func webAssemblyHandler(c echo.Context) error {
@@ -236,22 +549,24 @@ func webAssemblyHandler(c echo.Context) error {
 		return fmt.Errorf("parse parameters error: %w", err)
 	}
 
-	runtime, err := getRuntime(p.Runtime)
-	if err != nil {
-		return fmt.Errorf("get runtime error: %w", err)
+	if err := resolveParams(c, &p); err != nil {
+		return err
 	}
 
-	etag := p.Sha1()
+	debugUpstreamHeader(c, func() (string, error) { return runtimeURL(c.Request().Context(), p.Runtime) })
 
-	if c.Request().Header.Get("If-None-Match") == etag {
-		return c.NoContent(http.StatusNotModified)
+	runtime, status, err := getRuntime(c.Request().Context(), p.Runtime)
+	if err != nil {
+		return fetchError(fmt.Errorf("get runtime error: %w", err))
 	}
+	setCacheStatus(c, status)
+	defer cache.runtimes.hold(cacheKey(c.Request().Context(), p.Runtime))()
 
-	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, s-maxage=31536000")
-	c.Response().Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	c.Response().Header().Set("ETag", etag)
+	if runtime.BinaryEncoded == nil && streamWasmCompression() {
+		return streamGzip(c, contentType("carimbo.wasm", nil), runtime.Hash, runtime.Binary)
+	}
 
-	return c.Blob(http.StatusOK, "application/wasm", runtime.Binary)
+	return blobEncoded(c, contentType("carimbo.wasm", nil), runtime.Hash, runtime.Binary, runtime.BinaryEncoded)
 }
 
 func bundleHandler(c echo.Context) error {
@@ -260,22 +575,177 @@ func bundleHandler(c echo.Context) error {
 		return fmt.Errorf("parse parameters error: %w", err)
 	}
 
-	bundle, err := getBundle(p.Organization, p.Repository, p.Release)
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	return serveBundle(c, p)
+}
+
+// standaloneBundleHandler serves /:org/:repo/<release>.7z, the same bundle as
+// the prefixed route without a runtime segment to resolve.
+func standaloneBundleHandler(c echo.Context) error {
+	release, ok := strings.CutSuffix(c.Param("file"), ".7z")
+	if !ok {
+		return echo.ErrNotFound
+	}
+
+	p := Params{Organization: c.Param("org"), Repository: c.Param("repo"), Release: release}
+	if err := resolveRelease(c, &p); err != nil {
+		return err
+	}
+
+	return serveBundle(c, p)
+}
+
+func serveBundle(c echo.Context, p Params) error {
+	ctx := c.Request().Context()
+	url := bundleURL(p.Organization, p.Repository, p.Release)
+	debugUpstreamHeader(c, func() (string, error) { return bundleDownloadURL(ctx, p.Organization, p.Repository, p.Release) })
+
+	if threshold := int64(envInt("BUNDLE_STREAM_THRESHOLD", 0)); threshold > 0 {
+		if _, ok := cache.bundles.load(cacheKey(ctx, url)); !ok {
+			if download, err := bundleDownloadURL(ctx, p.Organization, p.Repository, p.Release); err == nil {
+				if size, err := upstreamSize(ctx, download); err == nil && size > threshold {
+					setCacheStatus(c, cacheMiss)
+					return streamUpstream(ctx, download, c, "application/octet-stream")
+				}
+			}
+		}
+	}
+
+	bundle, status, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+	setCacheStatus(c, status)
+	defer cache.bundles.hold(cacheKey(c.Request().Context(), url))()
+
+	c.Response().Header().Set("X-Bundle-CAS", casBundlePath(bundle))
+	return serveContent(c, "bundle.7z", "application/octet-stream", bundle.Hash, bundle.Modified, bundle.Data)
+}
+
+func contentsHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
+
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	bundle, status, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+	setCacheStatus(c, status)
+	defer cache.bundles.hold(cacheKey(c.Request().Context(), bundleURL(p.Organization, p.Repository, p.Release)))()
+
+	index, err := getBundleIndex(c.Request().Context(), bundle)
+	if err != nil {
+		return fmt.Errorf("bundle index error: %w", err)
+	}
+
+	if notModified(c, bundle.Hash) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.JSON(http.StatusOK, index.Entries)
+}
+
+func tarGzHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
+
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	bundle, status, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+	setCacheStatus(c, status)
+	defer cache.bundles.hold(cacheKey(c.Request().Context(), bundleURL(p.Organization, p.Repository, p.Release)))()
+
+	index, err := getBundleIndex(c.Request().Context(), bundle)
 	if err != nil {
-		return fmt.Errorf("get bundle error: %w", err)
+		return fmt.Errorf("bundle index error: %w", err)
 	}
 
-	etag := p.Sha1()
+	etag := bundle.Hash + "-tgz"
 
-	if c.Request().Header.Get("If-None-Match") == etag {
+	if notModified(c, etag) {
 		return c.NoContent(http.StatusNotModified)
 	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := contextWriter{ResponseWriter: c.Response(), ctx: c.Request().Context()}
+	if err := writeTarGz(w, index, bundle.Modified); err != nil {
+		return fmt.Errorf("write tar.gz error: %w", err)
+	}
+
+	return nil
+}
+
+func bundleFileHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
 
-	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, s-maxage=31536000")
-	c.Response().Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	c.Response().Header().Set("ETag", etag)
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	bundle, status, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+	setCacheStatus(c, status)
+	defer cache.bundles.hold(cacheKey(c.Request().Context(), bundleURL(p.Organization, p.Repository, p.Release)))()
 
-	return c.Blob(http.StatusOK, "application/octet-stream", bundle)
+	index, err := getBundleIndex(c.Request().Context(), bundle)
+	if err != nil {
+		return fmt.Errorf("bundle index error: %w", err)
+	}
+
+	name := c.Param("*")
+	content, ok := index.Files[name]
+	if !ok {
+		return echo.NotFoundHandler(c)
+	}
+
+	etag := bundle.Hash + "-" + name
+	for _, entry := range index.Entries {
+		if entry.Name == name {
+			etag = entry.Hash
+			break
+		}
+	}
+
+	return serveContent(c, name, contentType(name, content), etag, bundle.Modified, content)
+}
+
+func faviconHandler(static fs.FS) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		content, err := fs.ReadFile(static, "assets/favicon.ico")
+		if err == nil {
+			return c.Blob(http.StatusOK, "image/x-icon", content)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("read favicon error: %w", err)
+		}
+
+		if envBool("FAVICON_EMPTY_OK", false) {
+			return c.Blob(http.StatusOK, "image/x-icon", nil)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
 }
 
 func assetsHandler(static fs.FS) echo.HandlerFunc {
@@ -302,15 +772,11 @@ func assetsHandler(static fs.FS) echo.HandlerFunc {
 
 		etag := fmt.Sprintf("%x", h.Sum(nil))
 
-		if c.Request().Header.Get("If-None-Match") == etag {
+		if notModified(c, etag) {
 			return c.NoContent(http.StatusNotModified)
 		}
 
-		c.Response().Header().Set("Cache-Control", "public, max-age=31536000, s-maxage=31536000")
-		c.Response().Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-		c.Response().Header().Set("ETag", etag)
-
-		c.Response().Header().Set(echo.HeaderContentType, http.DetectContentType(content))
+		c.Response().Header().Set(echo.HeaderContentType, contentType(path, content))
 		c.Response().WriteHeader(http.StatusOK)
 		if _, err = c.Response().Write(content); err != nil {
 			return fmt.Errorf("error writing response: %w", err)
@@ -320,17 +786,89 @@ func assetsHandler(static fs.FS) echo.HandlerFunc {
 	}
 }
 
-func main() {
+func newServer() *echo.Echo {
+	disk = newDiskCache(os.Getenv("CACHE_DIR"))
+
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
 	e.Pre(middleware.Recover())
+	e.Pre(middleware.RequestID())
+	e.Pre(maxPathLength(envInt("MAX_PATH_LENGTH", 2048)))
+	e.Pre(cleanPath(envBool("CLEAN_PATHS", true)))
+	e.Pre(stripPrefix(os.Getenv("STRIP_PREFIX")))
 	e.Pre(middleware.RemoveTrailingSlash())
-	e.Pre(middleware.GzipWithConfig(middleware.GzipConfig{MinLength: 3072}))
+	e.Pre(middleware.GzipWithConfig(middleware.GzipConfig{Skipper: skipGzip, Level: dynamicGzipLevel, MinLength: 3072}))
+	e.Use(requestMetrics)
+	e.Use(accessLog(envBool("ACCESS_LOG", true)))
+	e.Use(maintenance)
+	e.Use(cors(os.Getenv("CORS_ORIGINS"), envBool("CORS_CREDENTIALS", false)))
+	e.Use(clientConcurrency(envInt("MAX_CONCURRENT_PER_IP", 0)))
+	e.Use(tenant(os.Getenv("TENANT_HEADER"), os.Getenv("TENANT_DOMAIN"), os.Getenv("TENANTS")))
+	e.Use(debugDelay(envBool("DEBUG_DELAY_ENABLED", false), envDuration("DEBUG_DELAY_MAX", 30*time.Second)))
+	e.Use(serverTiming(envBool("SERVER_TIMING", true)))
+	e.Use(slowRequestLogger(time.Duration(envInt("SLOW_REQUEST_MS", 0)) * time.Millisecond))
+	e.Use(requestBudget(envDuration("REQUEST_BUDGET", 0)))
+	e.Use(retryBudget(envDuration("RETRY_BUDGET", 10*time.Second)))
+	e.Use(cacheTTLOverride)
+
+	registerRoutes(e)
+	loadPins()
+	prefetch()
+
+	if limit := memoryLimit(); limit > 0 && envBool("MEMORY_PRESSURE_EVICTION", false) {
+		watchMemory(limit, envInt("MEMORY_PRESSURE_PERCENT", 90), envDuration("MEMORY_CHECK_INTERVAL", 10*time.Second))
+	}
+
+	if envBool("DISK_AUDIT", false) {
+		disk.startAudit(envDuration("DISK_AUDIT_INTERVAL", time.Hour))
+	}
 
-	e.GET("/:runtime/:org/:repo/:release/:format", indexHandler)
-	e.GET("/:runtime/:org/:repo/:release/:format/carimbo.js", javaScriptHandler)
-	e.GET("/:runtime/:org/:repo/:release/:format/carimbo.wasm", webAssemblyHandler)
-	e.GET("/:runtime/:org/:repo/:release/:format/bundle.7z", bundleHandler)
-	e.GET("/:runtime/:org/:repo/:release/:format/assets/*", assetsHandler(assets))
+	return e
+}
+
+func main() {
+	selfTest := flag.Bool("selftest", false, "start the server, fetch a known runtime and bundle, and exit")
+	devDir := flag.String("dev", "", "serve a local game directory with live reload instead of a release")
+	devRuntime := flag.String("runtime", envString("DEFAULT_RUNTIME", latestAlias), "runtime version for -dev")
+	devFormat := flag.String("format", "720p", "canvas format for -dev")
+	flag.Parse()
+
+	output, err := configureLogging()
+	if err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	if err := loadTagPattern(); err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	e := newServer()
+	e.Logger.SetOutput(output)
+
+	if *selfTest {
+		if err := runSelfTest(e); err != nil {
+			slog.Error("self-test failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("self-test passed")
+		return
+	}
+
+	port := os.Getenv("PORT")
+	if *devDir != "" {
+		project, err := newDevProject(*devDir, *devRuntime, *devFormat)
+		if err != nil {
+			slog.Error("dev mode error", "error", err)
+			os.Exit(1)
+		}
+		project.register(e)
+		go project.watch(context.Background(), envDuration("DEV_POLL_INTERVAL", 500*time.Millisecond))
+
+		port = envString("PORT", "8080")
+		slog.Info("serving local game", "dir", *devDir, "runtime", *devRuntime, "url", "http://localhost:"+port+"/")
+	}
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", os.Getenv("PORT"))))
+	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", port)))
 }
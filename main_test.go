@@ -0,0 +1,452 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+
+	"github.com/labstack/echo/v4"
+)
+
+// zipArchive builds an in-memory zip holding files in the given order, as
+// name/content pairs.
+func zipArchive(t testing.TB, files ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatalf("zip create: %v", err)
+		}
+		if _, err := w.Write([]byte(files[i+1])); err != nil {
+			t.Fatalf("zip write: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestIndexPinsRuntimeFromPath(t *testing.T) {
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/1.2.3/o/r/1.0.0/720p", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET index = %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`<meta name="carimbo:runtime" content="1.2.3">`,
+		`runtime: "1.2.3"`,
+		`<base href="/1.2.3/o/r/1.0.0/720p/" />`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("index does not contain %s", want)
+		}
+	}
+}
+
+func TestIndexPinsResolvedLatestRuntime(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/flippingpixels/carimbo/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"tag_name":"v9.204.0"},{"tag_name":"v9.203.9"}]`)
+	}))
+	defer api.Close()
+
+	t.Setenv("GITHUB_API_URL", api.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("LATEST_TTL", "1ns")
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/o/r/1.0.0/720p", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET index = %d: %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `runtime: "9.204.0"`) || !strings.Contains(body, `<base href="/9.204.0/o/r/1.0.0/720p/" />`) {
+		t.Errorf("index not pinned to the latest runtime 9.204.0:\n%s", body)
+	}
+}
+
+// endlessReader yields chunks forever, calling onRead after each one.
+type endlessReader struct {
+	reads  int
+	onRead func(n int)
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.onRead != nil {
+		r.onRead(r.reads)
+	}
+	return len(p), nil
+}
+
+func TestCopyContextStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := &endlessReader{onRead: func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}}
+
+	written, err := copyContext(ctx, io.Discard, src)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("copyContext error = %v, want context.Canceled", err)
+	}
+	if src.reads != 3 {
+		t.Errorf("copyContext read %d chunks, want it to stop right after the cancelling read", src.reads)
+	}
+	if written == 0 {
+		t.Error("copyContext wrote nothing before the cancellation")
+	}
+}
+
+func TestContextWriterRefusesWritesAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	w := contextWriter{ResponseWriter: rec, ctx: ctx}
+
+	if _, err := w.Write([]byte("before")); err != nil {
+		t.Fatalf("write before cancel: %v", err)
+	}
+	cancel()
+	if _, err := w.Write([]byte("after")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("write after cancel error = %v, want context.Canceled", err)
+	}
+
+	if got := rec.Body.String(); got != "before" {
+		t.Errorf("body = %q, want only the bytes written before cancelling", got)
+	}
+}
+
+func TestXCacheMissThenHit(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('x-cache')", "carimbo.wasm", "\x00asm x-cache")
+	bundle := sevenZipArchive(t, "main.lua", "print('x-cache')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/WebAssembly.zip"):
+			w.Write(runtimeZip)
+		case strings.HasSuffix(r.URL.Path, "/bundle.7z"):
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for _, path := range []string{"carimbo.js", "carimbo.wasm", "bundle.7z"} {
+		for _, want := range []string{"MISS", "HIT"} {
+			if path == "carimbo.wasm" && want == "MISS" {
+				// carimbo.js already brought the runtime in.
+				want = "HIT"
+			}
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.215.0/o/r/1.0.0/720p/"+path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d: %s", path, rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("X-Cache"); got != want {
+				t.Errorf("GET %s X-Cache = %q, want %q", path, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkCopyContext compares the pooled copy used by the rewrite path with
+// a plain io.Copy that allocates a fresh buffer on every call. The wrappers
+// hide ReaderFrom and WriterTo so io.Copy cannot skip its own buffer.
+func BenchmarkCopyContext(b *testing.B) {
+	payload := bytes.Repeat([]byte("carimbo"), 64*1024)
+	ctx := context.Background()
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dst := struct{ io.Writer }{io.Discard}
+			if _, err := copyContext(ctx, dst, struct{ io.Reader }{bytes.NewReader(payload)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dst := struct{ io.Writer }{io.Discard}
+			if _, err := io.Copy(dst, struct{ io.Reader }{bytes.NewReader(payload)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestIndexHead(t *testing.T) {
+	e := newServer()
+
+	get := httptest.NewRecorder()
+	e.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/9.236.0/o/r/1.0.0/720p", nil))
+	if get.Code != http.StatusOK {
+		t.Fatalf("GET index = %d: %s", get.Code, get.Body)
+	}
+
+	head := httptest.NewRecorder()
+	e.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/9.236.0/o/r/1.0.0/720p", nil))
+	if head.Code != http.StatusOK {
+		t.Fatalf("HEAD index = %d", head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD index wrote a %d byte body", head.Body.Len())
+	}
+	if got := head.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("HEAD Content-Type = %q, want text/html", got)
+	}
+	// Each render escapes its own nonce, so the length only roughly
+	// matches the GET it is compared with.
+	n, err := strconv.Atoi(head.Header().Get("Content-Length"))
+	if err != nil || n < get.Body.Len()-64 || n > get.Body.Len()+64 {
+		t.Errorf("HEAD Content-Length = %q, want about the GET body length %d", head.Header().Get("Content-Length"), get.Body.Len())
+	}
+}
+
+func TestIndexPathOverridesEmbeddedIndex(t *testing.T) {
+	custom := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(custom, []byte(`<title>custom {{ .Runtime }}</title>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := newServer()
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.247.0/o/r/1.0.0/720p", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET index = %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	t.Setenv("INDEX_PATH", custom)
+	if body := get(); body != "<title>custom 9.247.0</title>" {
+		t.Errorf("index from INDEX_PATH = %q", body)
+	}
+
+	// Edits are picked up without a restart.
+	if err := os.WriteFile(custom, []byte(`<title>edited {{ .Runtime }}</title>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != "<title>edited 9.247.0</title>" {
+		t.Errorf("index after editing INDEX_PATH = %q", body)
+	}
+
+	t.Setenv("INDEX_PATH", filepath.Join(t.TempDir(), "missing.html"))
+	if body := get(); !strings.Contains(body, `<meta name="carimbo:runtime" content="9.247.0">`) {
+		t.Errorf("index with a missing INDEX_PATH did not fall back to the embedded page:\n%s", body)
+	}
+}
+
+func TestFaviconModes(t *testing.T) {
+	serve := func(static fs.FS) *httptest.ResponseRecorder {
+		e := echo.New()
+		e.GET("/favicon.ico", faviconHandler(static))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+		return rec
+	}
+
+	icon := fstest.MapFS{"assets/favicon.ico": {Data: []byte("\x00\x00\x01\x00icon")}}
+	if rec := serve(icon); rec.Code != http.StatusOK || rec.Body.String() != "\x00\x00\x01\x00icon" {
+		t.Errorf("embedded favicon = %d %q, want the icon", rec.Code, rec.Body)
+	}
+
+	if rec := serve(fstest.MapFS{}); rec.Code != http.StatusNoContent {
+		t.Errorf("missing favicon by default = %d, want 204", rec.Code)
+	}
+
+	t.Setenv("FAVICON_EMPTY_OK", "true")
+	rec := serve(fstest.MapFS{})
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("missing favicon with FAVICON_EMPTY_OK = %d with %d bytes, want an empty 200", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/x-icon" {
+		t.Errorf("empty favicon Content-Type = %q, want image/x-icon", got)
+	}
+
+	if rec := serve(icon); rec.Body.Len() == 0 {
+		t.Error("FAVICON_EMPTY_OK hid the embedded icon")
+	}
+}
+
+func TestRuntimeWithNonWasmBinary(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('html')", "carimbo.wasm", "<!DOCTYPE html><p>not wasm</p>")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	resetState(t)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.252.0/o/r/1.0.0/720p/carimbo.wasm", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("GET carimbo.wasm without the wasm magic = %d, want 502: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "malformed runtime") {
+		t.Errorf("error body = %s, want it to name a malformed runtime", rec.Body)
+	}
+	if _, ok := cache.runtimes.load("9.252.0"); ok {
+		t.Error("malformed runtime was cached")
+	}
+}
+
+func TestWasmRangeRequest(t *testing.T) {
+	binary := "\x00asm" + strings.Repeat("\x01\x02\x03\x04", 1024)
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('range')", "carimbo.wasm", binary)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	resetState(t)
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/9.254.0/o/r/1.0.0/720p/carimbo.wasm", nil)
+	req.Header.Set("Range", "bytes=0-1023")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("GET carimbo.wasm with a Range = %d, want 206", rec.Code)
+	}
+	if got, want := rec.Header().Get("Content-Range"), "bytes 0-1023/"+strconv.Itoa(len(binary)); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if rec.Body.String() != binary[:1024] {
+		t.Errorf("partial body is %d bytes, want the first 1024 of the wasm", rec.Body.Len())
+	}
+	if got := rec.Header().Get("Cache-Control"); !strings.Contains(got, "max-age=31536000") {
+		t.Errorf("Cache-Control on a partial response = %q, want the immutable policy", got)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.254.0/o/r/1.0.0/720p/carimbo.wasm", nil))
+	if rec.Header().Get("Accept-Ranges") != "bytes" || rec.Header().Get("Content-Length") != strconv.Itoa(len(binary)) {
+		t.Errorf("full wasm Accept-Ranges %q Content-Length %q, want bytes and %d", rec.Header().Get("Accept-Ranges"), rec.Header().Get("Content-Length"), len(binary))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/9.254.0/o/r/1.0.0/720p/carimbo.wasm", nil)
+	req.Header.Set("Range", "bytes=99999-")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("GET carimbo.wasm past its end = %d, want 416", rec.Code)
+	}
+}
+
+func TestIndexConditionalRequest(t *testing.T) {
+	e := newServer()
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("/9.274.0/o/r/1.0.0/720p", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET index = %d with ETag %q, want a 200 with an ETag", first.Code, etag)
+	}
+
+	// The nonce differs per render but is left out of the ETag.
+	if again := get("/9.274.0/o/r/1.0.0/720p", ""); again.Header().Get("ETag") != etag {
+		t.Errorf("second render ETag = %q, want %q", again.Header().Get("ETag"), etag)
+	}
+
+	rec := get("/9.274.0/o/r/1.0.0/720p", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("GET index with If-None-Match = %d with %d bytes, want an empty 304", rec.Code, rec.Body.Len())
+	}
+
+	// The ETag follows the data injected into the page.
+	if rec := get("/9.274.0/o/r/1.0.0/480p", etag); rec.Code != http.StatusOK {
+		t.Errorf("GET another format's index with the 720p ETag = %d, want 200", rec.Code)
+	}
+	t.Setenv("VERSION_PICKER", "true")
+	if rec := get("/9.274.0/o/r/1.0.0/720p", etag); rec.Code != http.StatusOK {
+		t.Errorf("GET index with the picker turned on = %d, want 200 for the changed page", rec.Code)
+	}
+}
+
+func TestOptionsListsAllowedMethods(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	e := newServer()
+
+	for path, want := range map[string][]string{
+		"/9.289.0/o/r/1.0.0/720p/carimbo.wasm": {http.MethodGet, http.MethodHead},
+		"/9.289.0/o/r/1.0.0/720p/bundle.7z":    {http.MethodGet, http.MethodHead},
+		"/9.289.0/o/r/1.0.0/720p":              {http.MethodGet, http.MethodHead},
+		"/healthz":                             {http.MethodGet},
+		"/admin/pins":                          {http.MethodPost, http.MethodDelete},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, path, nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s = %d, want 204", path, rec.Code)
+			continue
+		}
+
+		allow := rec.Header().Get("Allow")
+		for _, method := range append(want, http.MethodOptions) {
+			if !strings.Contains(allow, method) {
+				t.Errorf("OPTIONS %s Allow = %q, want %s in it", path, allow, method)
+			}
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("OPTIONS requests reached upstream %d times, want none", n)
+	}
+}
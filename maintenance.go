@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maintenanceMode starts from MAINTENANCE and is flipped at runtime through
+// /admin/maintenance.
+var maintenanceMode atomic.Bool
+
+func init() {
+	maintenanceMode.Store(envBool("MAINTENANCE", false))
+}
+
+// maintenance answers 503 with the maintenance Retry-After while the switch is
+// on. Liveness, metrics and the admin surface stay up, so the switch can be
+// turned off again; readiness reports unavailable to drain load balancers.
+func maintenance(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !maintenanceMode.Load() {
+			return next(c)
+		}
+
+		path := c.Request().URL.Path
+		if path == "/healthz" || path == "/metrics" || path == "/status" || strings.HasPrefix(path, "/admin/") {
+			return next(c)
+		}
+		return serviceUnavailable(causeMaintenance, "down for maintenance", nil)
+	}
+}
+
+func maintenanceHandler(c echo.Context) error {
+	enabled := c.Request().Method != http.MethodDelete
+	if maintenanceMode.Swap(enabled) != enabled {
+		slog.Info("maintenance mode changed", "enabled", enabled)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ManifestEntry struct {
+	URL         string `json:"url"`
+	Size        int    `json:"size"`
+	ContentType string `json:"content_type"`
+	Integrity   string `json:"integrity"`
+}
+
+func integrity(content []byte) string {
+	sum := sha512.Sum384(content)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func manifestHandler(c echo.Context) error {
+	p := Params{}
+	if err := c.Bind(&p); err != nil {
+		return fmt.Errorf("parse parameters error: %w", err)
+	}
+
+	if err := resolveParams(c, &p); err != nil {
+		return err
+	}
+
+	runtime, _, err := getRuntime(c.Request().Context(), p.Runtime)
+	if err != nil {
+		return fetchError(fmt.Errorf("get runtime error: %w", err))
+	}
+
+	bundle, _, err := getBundle(c.Request().Context(), p.Organization, p.Repository, p.Release)
+	if err != nil {
+		return fetchError(fmt.Errorf("get bundle error: %w", err))
+	}
+
+	script, _, etag, err := runtimeScript(p, runtime)
+	if err != nil {
+		return err
+	}
+	scriptIntegrity := runtime.ScriptIntegrity
+	if etag != runtime.Hash {
+		scriptIntegrity = integrity(script)
+	}
+
+	base := assetBase(p)
+	entry := func(name, typ string, content []byte, sri string) ManifestEntry {
+		return ManifestEntry{URL: base + name, Size: len(content), ContentType: typ, Integrity: sri}
+	}
+
+	return c.JSON(http.StatusOK, []ManifestEntry{
+		entry("carimbo.js", contentType("carimbo.js", nil), script, scriptIntegrity),
+		entry("carimbo.wasm", contentType("carimbo.wasm", nil), runtime.Binary, runtime.BinaryIntegrity),
+		entry("bundle.7z", "application/octet-stream", bundle.Data, bundle.Integrity),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestManifestDescribesServedAssets(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", `fetch("carimbo.wasm")`, "carimbo.wasm", "\x00asm manifest")
+	bundle := sevenZipArchive(t, "main.lua", "print('manifest')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/bundle.7z") {
+			w.Write(bundle)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	// The manifest is cached publicly, so a spoofed Host must not reach it.
+	req := httptest.NewRequest(http.MethodGet, "/9.254.0/o/r/1.0.0/720p/manifest.json", nil)
+	req.Host = "evil.example"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if strings.Contains(rec.Body.String(), "evil.example") {
+		t.Errorf("manifest embeds the spoofed Host: %s", rec.Body)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET manifest.json = %d: %s", rec.Code, rec.Body)
+	}
+
+	var entries []ManifestEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("manifest = %+v, want js, wasm and bundle", entries)
+	}
+
+	for i, want := range []struct {
+		name, contentType string
+	}{
+		{"carimbo.js", "application/javascript; charset=utf-8"},
+		{"carimbo.wasm", "application/wasm"},
+		{"bundle.7z", "application/octet-stream"},
+	} {
+		entry := entries[i]
+		if entry.URL != "/9.254.0/o/r/1.0.0/720p/"+want.name {
+			t.Errorf("entry %d URL = %s, want %s under the asset base", i, entry.URL, want.name)
+		}
+		if entry.ContentType != want.contentType {
+			t.Errorf("%s content type = %q, want %q", want.name, entry.ContentType, want.contentType)
+		}
+
+		// Sizes and SRI hashes must match the bytes the asset routes serve.
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, entry.URL, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", entry.URL, rec.Code)
+		}
+		if entry.Size != rec.Body.Len() {
+			t.Errorf("%s size = %d, want the served %d", want.name, entry.Size, rec.Body.Len())
+		}
+		if got := integrity(rec.Body.Bytes()); entry.Integrity != got {
+			t.Errorf("%s integrity = %s, want %s", want.name, entry.Integrity, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// memoryLimit is MEMORY_SOFT_LIMIT, falling back to GOMEMLIMIT; zero means
+// neither is set.
+func memoryLimit() int64 {
+	if limit := int64(envInt("MEMORY_SOFT_LIMIT", 0)); limit > 0 {
+		return limit
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return limit
+	}
+	return 0
+}
+
+// relieveMemory sheds cache entries until the excess heap above threshold has
+// been released from the caches. Bundle indexes go first: they hold the
+// decompressed files, so they are usually the largest, and can be rebuilt
+// from a cached bundle without going upstream. Bundles follow, then runtimes.
+func relieveMemory(heap, threshold int64) {
+	if heap <= threshold {
+		return
+	}
+
+	excess := heap - threshold
+	freed := cache.indexes.shed(excess)
+	if freed < excess {
+		freed += cache.bundles.shed(excess-freed, "memory")
+	}
+	if freed < excess {
+		freed += cache.runtimes.shed(excess-freed, "memory")
+	}
+
+	slog.Warn("memory pressure, evicted cache entries", "heap", heap, "threshold", threshold, "freed", freed)
+	if freed > 0 {
+		debug.FreeOSMemory()
+	}
+}
+
+func watchMemory(limit int64, percent int, interval time.Duration) {
+	threshold := limit * int64(percent) / 100
+
+	go func() {
+		var stats runtime.MemStats
+		for range time.Tick(interval) {
+			runtime.ReadMemStats(&stats)
+			relieveMemory(int64(stats.HeapAlloc), threshold)
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRelieveMemoryShedsBundlesFirst(t *testing.T) {
+	logs := captureLogs(t)
+	previous := cache
+	t.Cleanup(func() { cache = previous })
+	cache.runtimes = newStore("test-285-runtime", storeLimits{}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	cache.bundles = newStore("test-285-bundle", storeLimits{}, func(b Bundle) string { return b.Hash }, func(b Bundle) int64 { return int64(len(b.Data)) })
+	cache.indexes = newBundleIndexCache(1 << 20)
+
+	for _, key := range []string{"o/r/1.0.0", "o/r/1.1.0"} {
+		cache.bundles.store(key, Bundle{Data: []byte(strings.Repeat("b", 100)), Hash: key}, 0)
+	}
+	cache.runtimes.store("9.285.0", Runtime{Script: []byte(strings.Repeat("r", 100)), Hash: "9.285.0"}, 0)
+
+	relieveMemory(900, 1000)
+	if n := cache.bundles.len() + cache.runtimes.len(); n != 3 {
+		t.Fatalf("heap under the threshold evicted entries, %d left", n)
+	}
+
+	// 150 bytes over: both bundles go, the runtime stays.
+	relieveMemory(1150, 1000)
+	if n := cache.bundles.len(); n != 0 {
+		t.Errorf("%d bundles left after shedding, want both evicted", n)
+	}
+	if _, ok := cache.runtimes.load("9.285.0"); !ok {
+		t.Error("runtime evicted although the bundles covered the excess")
+	}
+	if !strings.Contains(logs.String(), "memory pressure") || !strings.Contains(logs.String(), "freed=200") {
+		t.Errorf("memory pressure was not logged with what it freed:\n%s", logs)
+	}
+
+	relieveMemory(1050, 1000)
+	if _, ok := cache.runtimes.load("9.285.0"); ok {
+		t.Error("runtime kept with no bundles left to shed")
+	}
+}
+
+func TestRelieveMemoryShedsBundleIndexesBeforeBundles(t *testing.T) {
+	previous := cache
+	t.Cleanup(func() { cache = previous })
+	cache.runtimes = newStore("test-285-runtime", storeLimits{}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	cache.bundles = newStore("test-285-bundle", storeLimits{}, func(b Bundle) string { return b.Hash }, func(b Bundle) int64 { return int64(len(b.Data)) })
+	cache.indexes = newBundleIndexCache(1 << 20)
+
+	cache.bundles.store("o/r/1.0.0", Bundle{Data: []byte(strings.Repeat("b", 100)), Hash: "bundle"}, 0)
+	for _, key := range []string{"old", "new"} {
+		cache.indexes.Store(key, &BundleIndex{Files: map[string][]byte{"main.lua": []byte(strings.Repeat("i", 100))}, Size: 100})
+	}
+
+	// 50 bytes over: the least recently used index covers it.
+	relieveMemory(1050, 1000)
+	if _, ok := cache.indexes.Load("old"); ok {
+		t.Error("least recently used index kept under memory pressure")
+	}
+	if _, ok := cache.indexes.Load("new"); !ok {
+		t.Error("second index evicted although the first covered the excess")
+	}
+	if n := cache.bundles.len(); n != 1 {
+		t.Errorf("%d bundles left, want the bundle kept while indexes could be shed", n)
+	}
+
+	// 150 bytes over: the last index and then the bundle go.
+	relieveMemory(1150, 1000)
+	if _, ok := cache.indexes.Load("new"); ok {
+		t.Error("index kept under memory pressure")
+	}
+	if n := cache.bundles.len(); n != 0 {
+		t.Errorf("%d bundles left, want the bundle shed once the indexes were gone", n)
+	}
+}
+
+func TestMemoryLimitFromEnv(t *testing.T) {
+	t.Setenv("MEMORY_SOFT_LIMIT", "536870912")
+	if got := memoryLimit(); got != 512<<20 {
+		t.Errorf("memoryLimit with MEMORY_SOFT_LIMIT = %d, want %d", got, 512<<20)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var activeDownloads atomic.Int64
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "play_active_downloads",
+	Help: "Upstream downloads currently in progress.",
+}, func() float64 { return float64(activeDownloads.Load()) })
+
+var upstreamHTML = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "play_upstream_html_total",
+	Help: "Upstream downloads that returned an HTML page instead of an archive.",
+})
+
+var evictions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "play_cache_evictions_total",
+	Help: "Entries evicted from the in-memory caches, by reason.",
+}, []string{"kind", "reason"})
+
+var contentChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "play_cache_content_changes_total",
+	Help: "Refreshes that found different content upstream than the cached entry.",
+}, []string{"kind"})
+
+var upstreamExhausted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "play_upstream_retries_exhausted_total",
+	Help: "Upstream downloads that failed on every attempt the retry budget allowed.",
+})
+
+var upstreamFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "play_upstream_failures_total",
+	Help: "Upstream downloads that failed after any retries.",
+})
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "play_http_requests_total",
+		Help: "Requests served, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "play_http_request_duration_seconds",
+		Help:    "Request latency by route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+	}, []string{"route"})
+)
+
+func init() {
+	for _, s := range []interface{ counters() cacheCounters }{cache.runtimes, cache.bundles} {
+		s := s
+		kind := s.counters().kind
+		labels := prometheus.Labels{"kind": kind}
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: "play_cache_hits_total", Help: "Cache lookups served from memory.", ConstLabels: labels}, func() float64 { return float64(s.counters().hits) })
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: "play_cache_misses_total", Help: "Cache lookups that required an upstream fetch.", ConstLabels: labels}, func() float64 { return float64(s.counters().misses) })
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: "play_cache_entries", Help: "Entries currently held in memory.", ConstLabels: labels}, func() float64 { return float64(s.counters().entries) })
+	}
+}
+
+// requestMetrics records every request against its route pattern rather than
+// its path, keeping label cardinality bounded.
+func requestMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		code := c.Response().Status
+		var he *echo.HTTPError
+		if err != nil && !c.Response().Committed {
+			code = http.StatusInternalServerError
+			if errors.As(err, &he) {
+				code = he.Code
+			}
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		requests.WithLabelValues(route, c.Request().Method, strconv.Itoa(code)).Inc()
+		requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func trackDownload() func() {
+	activeDownloads.Add(1)
+	return func() { activeDownloads.Add(-1) }
+}
+
+type Stats struct {
+	ActiveDownloads int64 `json:"active_downloads"`
+	Runtimes        int   `json:"runtimes"`
+	Bundles         int   `json:"bundles"`
+}
+
+func statsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, Stats{
+		ActiveDownloads: activeDownloads.Load(),
+		Runtimes:        cache.runtimes.len(),
+		Bundles:         cache.bundles.len(),
+	})
+}
+
+var metricsHandler = echo.WrapHandler(promhttp.Handler())
+
+func cacheStatsHandler(c echo.Context) error {
+	stores := []cacheCounters{cache.runtimes.counters(), cache.bundles.counters()}
+
+	var sb strings.Builder
+	metric := func(name, typ, help string, value func(cacheCounters) int64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range stores {
+			fmt.Fprintf(&sb, "%s{kind=%q} %d\n", name, s.kind, value(s))
+		}
+	}
+
+	metric("play_cache_hits_total", "counter", "Cache lookups served from memory.", func(s cacheCounters) int64 { return s.hits })
+	metric("play_cache_misses_total", "counter", "Cache lookups that required an upstream fetch.", func(s cacheCounters) int64 { return s.misses })
+	metric("play_cache_stale_total", "counter", "Stale entries served after a failed refresh.", func(s cacheCounters) int64 { return s.stale })
+	metric("play_cache_entries", "gauge", "Entries currently held in memory.", func(s cacheCounters) int64 { return int64(s.entries) })
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(sb.String()))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// Run with -race: downloads and readers touch activeDownloads concurrently.
+func TestActiveDownloadsGauge(t *testing.T) {
+	const downloads = 8
+
+	started := make(chan struct{}, downloads)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.Write([]byte("payload"))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	stats := func() Stats {
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		var s Stats
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Errorf("decode /admin/stats: %v", err)
+		}
+		return s
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < downloads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := downloadOnce(context.Background(), upstream.URL+"/"+string(rune('a'+i)), nil); err != nil {
+				t.Errorf("download %d: %v", i, err)
+			}
+		}(i)
+	}
+
+	var readers sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if n := activeDownloads.Load(); n < 0 || n > downloads {
+					t.Errorf("active downloads = %d, want 0..%d", n, downloads)
+				}
+				e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			}
+		}()
+	}
+
+	<-started
+	if n := stats().ActiveDownloads; n < 1 {
+		t.Errorf("active downloads while one is in flight = %d, want at least 1", n)
+	}
+
+	close(unblock)
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if n := stats().ActiveDownloads; n != 0 {
+		t.Errorf("active downloads after every fetch returned = %d, want 0", n)
+	}
+}
+
+func TestCacheStatsIsExpositionFormat(t *testing.T) {
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache-stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /cache-stats = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition type", got)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(rec.Body.String()))
+	if err != nil {
+		t.Fatalf("parse /cache-stats: %v\n%s", err, rec.Body)
+	}
+	for _, name := range []string{"play_cache_hits_total", "play_cache_misses_total", "play_cache_stale_total", "play_cache_entries"} {
+		family, ok := families[name]
+		if !ok {
+			t.Errorf("/cache-stats has no %s", name)
+			continue
+		}
+		kinds := map[string]bool{}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "kind" {
+					kinds[label.GetValue()] = true
+				}
+			}
+		}
+		if len(kinds) != 2 {
+			t.Errorf("%s has kinds %v, want one series per store", name, kinds)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func slowRequestLogger(threshold time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if threshold <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			if elapsed := time.Since(start); elapsed > threshold {
+				slog.Warn("slow request",
+					"path", c.Request().URL.Path,
+					"runtime", c.Param("runtime"),
+					"cache_miss", c.Get(cacheStatusKey) == cacheMiss,
+					"duration", elapsed,
+				)
+			}
+
+			return err
+		}
+	}
+}
+
+func requestBudget(budget time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if budget <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), budget)
+			defer cancel()
+
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Response().Committed {
+				return echo.NewHTTPError(http.StatusGatewayTimeout, "request exceeded its latency budget").SetInternal(err)
+			}
+
+			return err
+		}
+	}
+}
+
+func retryBudget(budget time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if budget <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			c.SetRequest(c.Request().WithContext(withRetryBudget(c.Request().Context(), budget)))
+			return next(c)
+		}
+	}
+}
+
+func stripPrefix(prefix string) echo.MiddlewareFunc {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if prefix == "" {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			u := c.Request().URL
+			if rest, ok := strings.CutPrefix(u.Path, prefix); ok && (rest == "" || rest[0] == '/') {
+				u.Path = "/" + strings.TrimPrefix(rest, "/")
+				if u.RawPath != "" {
+					u.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(u.RawPath, prefix), "/")
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+func maxPathLength(limit int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			if len(c.Request().URL.Path) > limit {
+				return echo.NewHTTPError(http.StatusRequestURITooLong, "request path too long")
+			}
+			return next(c)
+		}
+	}
+}
+
+func debugDelay(enabled bool, limit time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !enabled {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			raw := c.Request().Header.Get("X-Debug-Delay")
+			if raw == "" {
+				return next(c)
+			}
+
+			delay, err := time.ParseDuration(raw)
+			if err != nil || delay < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid X-Debug-Delay")
+			}
+			delay = min(delay, limit)
+
+			select {
+			case <-c.Request().Context().Done():
+				return c.Request().Context().Err()
+			case <-time.After(delay):
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func clientConcurrency(limit int) echo.MiddlewareFunc {
+	var (
+		mu       sync.Mutex
+		inflight = map[string]int{}
+	)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			ip := c.RealIP()
+
+			mu.Lock()
+			if inflight[ip] >= limit {
+				mu.Unlock()
+				return echo.NewHTTPError(http.StatusTooManyRequests, "too many concurrent requests")
+			}
+			inflight[ip]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				if inflight[ip]--; inflight[ip] == 0 {
+					delete(inflight, ip)
+				}
+				mu.Unlock()
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+func cleanPath(enabled bool) echo.MiddlewareFunc {
+	clean := func(p string) string {
+		cleaned := path.Clean("/" + p)
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		return cleaned
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !enabled {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			u := c.Request().URL
+			u.Path = clean(u.Path)
+			if u.RawPath != "" {
+				u.RawPath = clean(u.RawPath)
+			}
+			return next(c)
+		}
+	}
+}
+
+// cacheTTLOverride lets an admin request set X-Cache-TTL to control how long
+// the entries it fetches stay fresh; the header is ignored for anyone else.
+func cacheTTLOverride(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		raw := c.Request().Header.Get("X-Cache-TTL")
+		if raw == "" || !validAdminToken(strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")) {
+			return next(c)
+		}
+
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid X-Cache-TTL")
+		}
+
+		c.SetRequest(c.Request().WithContext(withCacheTTL(c.Request().Context(), ttl)))
+		return next(c)
+	}
+}
+
+// cors allows the listed origins to fetch from us. With credentials the
+// matching Origin is echoed back, since browsers reject a wildcard there.
+func cors(origins string, credentials bool) echo.MiddlewareFunc {
+	var allowed []string
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed = append(allowed, origin)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+
+	if credentials && slices.Contains(allowed, "*") {
+		slog.Error("CORS_CREDENTIALS needs explicit origins, ignoring it", "origins", origins)
+		credentials = false
+	}
+
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     allowed,
+		AllowMethods:     []string{http.MethodGet, http.MethodHead},
+		AllowCredentials: credentials,
+		ExposeHeaders:    []string{"ETag", "X-Cache", "X-Bundle-CAS"},
+	})
+}
+
+func accessLog(enabled bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !enabled {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			var he *echo.HTTPError
+			if err != nil && !c.Response().Committed {
+				status = http.StatusInternalServerError
+				if errors.As(err, &he) {
+					status = he.Code
+				}
+			}
+
+			req := c.Request()
+			slog.Info("request",
+				"request_id", c.Response().Header().Get(echo.HeaderXRequestID),
+				"method", req.Method,
+				"path", req.URL.Path,
+				"route", c.Path(),
+				"status", status,
+				"bytes", c.Response().Size,
+				"duration", time.Since(start),
+				"remote_ip", c.RealIP(),
+				"user_agent", req.UserAgent(),
+				"cache", c.Response().Header().Get("X-Cache"),
+				"query", redactQuery(req.URL.Query()),
+			)
+			return err
+		}
+	}
+}
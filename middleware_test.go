@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// syncBuffer lets handlers log from server goroutines while the test reads.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs routes the default logger into a buffer for the rest of the
+// test.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+
+	logs := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestSlowRequestLogger(t *testing.T) {
+	logs := captureLogs(t)
+
+	e := echo.New()
+	e.Use(slowRequestLogger(20 * time.Millisecond))
+	e.GET("/:runtime/slow", func(c echo.Context) error {
+		setCacheStatus(c, cacheMiss)
+		time.Sleep(40 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/:runtime/fast", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/1.2.3/fast", nil))
+	if strings.Contains(logs.String(), "slow request") {
+		t.Fatalf("fast request was logged as slow:\n%s", logs)
+	}
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/1.2.3/slow", nil))
+	out := logs.String()
+	for _, want := range []string{"slow request", "path=/1.2.3/slow", "runtime=1.2.3", "cache_miss=true", "duration="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("slow log does not contain %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestRequestBudgetReturns504(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("REQUEST_BUDGET", "50ms")
+	e := newServer()
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.214.0/o/r/1.0.0/720p/carimbo.wasm", nil))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("GET carimbo.wasm = %d, want 504: %s", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("budgeted request took %v, well past its 50ms budget", elapsed)
+	}
+}
+
+func TestRequestBudgetLeavesFastRequestsAlone(t *testing.T) {
+	e := echo.New()
+	e.Use(requestBudget(time.Second))
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET / = %d, want 200", rec.Code)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('prefix')", "carimbo.wasm", "\x00asm prefix")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/flippingpixels/carimbo/releases/download/v9.230.0/WebAssembly.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("STRIP_PREFIX", "/cdn/")
+	t.Setenv("EARLY_HINTS", "true")
+	e := newServer()
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/cdn/9.230.0/o/r/1.0.0/720p/carimbo.js", http.StatusOK},
+		{"/cdn/healthz", http.StatusOK},
+		{"/cdnx/healthz", http.StatusNotFound},
+		{"/9.230.0/o/r/1.0.0/720p/carimbo.js", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("GET %s = %d, want %d: %s", tc.path, rec.Code, tc.code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cdn/9.230.0/o/r/1.0.0/720p", nil))
+	if !strings.Contains(rec.Body.String(), `<base href="/cdn/9.230.0/o/r/1.0.0/720p/" />`) {
+		t.Errorf("index page does not resolve assets under the prefix:\n%s", rec.Body)
+	}
+	if links := strings.Join(rec.Header().Values("Link"), ", "); !strings.Contains(links, "</cdn/9.230.0/o/r/1.0.0/720p/carimbo.js>") {
+		t.Errorf("Early Hints links %q do not point under the prefix", links)
+	}
+}
+
+func TestLongPathIsRejected(t *testing.T) {
+	e := newServer()
+
+	long := "/9.239.0/o/" + strings.Repeat("r", 4096) + "/1.0.0/720p"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, long, nil))
+	if rec.Code != http.StatusRequestURITooLong {
+		t.Fatalf("GET a %d byte path = %d, want 414", len(long), rec.Code)
+	}
+
+	t.Setenv("MAX_PATH_LENGTH", "8192")
+	rec = httptest.NewRecorder()
+	newServer().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, long, nil))
+	if rec.Code == http.StatusRequestURITooLong {
+		t.Errorf("GET a %d byte path under MAX_PATH_LENGTH=8192 = 414", len(long))
+	}
+}
+
+func TestDebugDelayOnlyWhenEnabled(t *testing.T) {
+	timed := func(e *echo.Echo, delay string) (int, time.Duration) {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.Header.Set("X-Debug-Delay", delay)
+		rec := httptest.NewRecorder()
+
+		start := time.Now()
+		e.ServeHTTP(rec, req)
+		return rec.Code, time.Since(start)
+	}
+
+	if code, elapsed := timed(newServer(), "200ms"); code != http.StatusOK || elapsed >= 200*time.Millisecond {
+		t.Errorf("X-Debug-Delay without DEBUG_DELAY_ENABLED = %d after %v, want an immediate 200", code, elapsed)
+	}
+
+	t.Setenv("DEBUG_DELAY_ENABLED", "true")
+	t.Setenv("DEBUG_DELAY_MAX", "150ms")
+	e := newServer()
+
+	if code, elapsed := timed(e, "100ms"); code != http.StatusOK || elapsed < 100*time.Millisecond {
+		t.Errorf("X-Debug-Delay: 100ms = %d after %v, want a 200 after at least 100ms", code, elapsed)
+	}
+	if _, elapsed := timed(e, "10s"); elapsed > time.Second {
+		t.Errorf("X-Debug-Delay: 10s took %v, want it capped at DEBUG_DELAY_MAX", elapsed)
+	}
+	if code, _ := timed(e, "soon"); code != http.StatusBadRequest {
+		t.Errorf("X-Debug-Delay: soon = %d, want 400", code)
+	}
+}
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	e := echo.New()
+	e.Use(clientConcurrency(2))
+	e.GET("/slow", func(c echo.Context) error {
+		entered <- struct{}{}
+		<-unblock
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fast", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	get := func(path, addr string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := get("/slow", "192.0.2.1:1234"); code != http.StatusOK {
+				t.Errorf("request within the limit = %d, want 200", code)
+			}
+		}()
+		<-entered
+	}
+
+	if code := get("/fast", "192.0.2.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("third concurrent request from one IP = %d, want 429", code)
+	}
+	if code := get("/fast", "192.0.2.2:1234"); code != http.StatusOK {
+		t.Errorf("request from another IP = %d, want 200", code)
+	}
+
+	close(unblock)
+	wg.Wait()
+	if code := get("/fast", "192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("request after the others finished = %d, want 200", code)
+	}
+}
+
+func TestDuplicateSlashesAndDotSegments(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('clean')", "carimbo.wasm", "\x00asm clean")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/flippingpixels/carimbo/releases/download/v9.268.0/WebAssembly.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for _, p := range []string{
+		"/9.268.0//o/r//1.0.0/720p/carimbo.js",
+		"//9.268.0/o/r/1.0.0/720p///carimbo.js",
+		"/9.268.0/o/./r/1.0.0/720p/./carimbo.js",
+		"/9.268.0/o/x/../r/1.0.0/720p/carimbo.js",
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "console.log('clean')" {
+			t.Errorf("GET %s = %d %q, want carimbo.js", p, rec.Code, rec.Body)
+		}
+	}
+
+	// The trailing slash of an index page survives cleaning.
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.268.0//o/r/1.0.0//720p/", nil))
+	if !strings.Contains(rec.Body.String(), `<base href="/9.268.0/o/r/1.0.0/720p/" />`) {
+		t.Errorf("index page for a doubled-slash path does not point at the clean base:\n%s", rec.Body)
+	}
+}
+
+func TestAdminCacheTTLOverride(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('ttl')", "carimbo.wasm", "\x00asm ttl")
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	get := func(ttl, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/9.276.0/o/r/1.0.0/720p/carimbo.js", nil)
+		req.Header.Set("X-Cache-TTL", ttl)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	ttl := func() time.Duration {
+		cached, ok := cache.runtimes.load("9.276.0")
+		if !ok {
+			t.Fatal("runtime was not cached")
+		}
+		return cached.ttl
+	}
+
+	cache.runtimes.purge("9.276.0")
+	if rec := get("20ms", "wrong"); rec.Code != http.StatusOK {
+		t.Fatalf("GET carimbo.js = %d: %s", rec.Code, rec.Body)
+	}
+	if got := ttl(); got != 0 {
+		t.Errorf("entry fetched by a non-admin X-Cache-TTL request has TTL %v, want the default", got)
+	}
+
+	cache.runtimes.purge("9.276.0")
+	hits.Store(0)
+	if rec := get("20ms", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("admin GET carimbo.js = %d: %s", rec.Code, rec.Body)
+	}
+	if got := ttl(); got != 20*time.Millisecond {
+		t.Errorf("entry fetched with X-Cache-TTL: 20ms has TTL %v", got)
+	}
+	if rec := get("", ""); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("GET within the overridden TTL X-Cache = %q, want HIT", rec.Header().Get("X-Cache"))
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if rec := get("", ""); rec.Header().Get("X-Cache") == "HIT" {
+		t.Error("GET past the overridden TTL was still a hit")
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream hits = %d, want the entry refetched once it expired", n)
+	}
+
+	if rec := get("soon", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("admin GET with X-Cache-TTL: soon = %d, want 400", rec.Code)
+	}
+}
+
+func TestCredentialedCORS(t *testing.T) {
+	request := func(e *echo.Echo, method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/healthz", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Setenv("CORS_ORIGINS", "https://embed.example, https://other.example")
+	t.Setenv("CORS_CREDENTIALS", "true")
+	e := newServer()
+
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		rec := request(e, method, "https://embed.example")
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://embed.example" {
+			t.Errorf("%s from an allowed origin Access-Control-Allow-Origin = %q, want the origin itself", method, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+			t.Errorf("%s from an allowed origin Access-Control-Allow-Credentials = %q, want true", method, got)
+		}
+	}
+	if got := request(e, http.MethodGet, "https://evil.example").Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("GET from an unlisted origin Access-Control-Allow-Origin = %q, want none", got)
+	}
+
+	// Browsers refuse a wildcard with credentials, so the pairing falls back
+	// to anonymous CORS.
+	logs := captureLogs(t)
+	t.Setenv("CORS_ORIGINS", "*")
+	rec := request(newServer(), http.MethodGet, "https://embed.example")
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("wildcard origin Access-Control-Allow-Credentials = %q, want none", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard origin Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if !strings.Contains(logs.String(), "CORS_CREDENTIALS needs explicit origins") {
+		t.Errorf("wildcard with credentials was not reported:\n%s", logs)
+	}
+}
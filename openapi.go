@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type object = map[string]any
+
+func jsonSchema(t reflect.Type) object {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := object{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type)
+		}
+		return object{"type": "object", "properties": properties}
+	}
+	return object{}
+}
+
+func openAPIPath(path string) (string, []object) {
+	segments := strings.Split(path, "/")
+	var parameters []object
+	for i, segment := range segments {
+		var name string
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			name = segment[1:]
+		case segment == "*":
+			name = "path"
+		default:
+			continue
+		}
+		segments[i] = "{" + name + "}"
+		parameters = append(parameters, object{"name": name, "in": "path", "required": true, "schema": object{"type": "string"}})
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+func openAPIDocument(table []Route) object {
+	paths := object{}
+	for _, r := range table {
+		path, parameters := openAPIPath(r.Path)
+
+		content := object{}
+		if r.Response != nil {
+			content["schema"] = jsonSchema(reflect.TypeOf(r.Response))
+		}
+
+		status := r.Status
+		if status == 0 {
+			status = http.StatusNoContent
+			if r.ContentType != "" {
+				status = http.StatusOK
+			}
+		}
+		response := object{"description": http.StatusText(status)}
+		if r.ContentType != "" {
+			response["content"] = object{r.ContentType: content}
+		}
+
+		operation := object{
+			"summary":   r.Summary,
+			"responses": object{strconv.Itoa(status): response},
+		}
+		if r.Request != nil {
+			operation["requestBody"] = object{
+				"required": true,
+				"content":  object{echo.MIMEApplicationJSON: object{"schema": jsonSchema(reflect.TypeOf(r.Request))}},
+			}
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if r.Admin {
+			operation["security"] = []object{{"bearer": []string{}}}
+		}
+
+		item, _ := paths[path].(object)
+		if item == nil {
+			item = object{}
+			paths[path] = item
+		}
+		for _, method := range r.Methods {
+			item[strings.ToLower(method)] = operation
+		}
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info":    object{"title": "play", "version": "1.0.0"},
+		"paths":   paths,
+		"components": object{
+			"securitySchemes": object{"bearer": object{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+var openAPI object
+
+func openAPIHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPI)
+}
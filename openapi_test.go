@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json = %d", rec.Code)
+	}
+
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json is not JSON: %v", err)
+	}
+	if doc.OpenAPI == "" {
+		t.Error("document has no openapi version")
+	}
+
+	for path, method := range map[string]string{
+		"/{runtime}/{org}/{repo}/{release}/{format}":              "get",
+		"/{runtime}/{org}/{repo}/{release}/{format}/carimbo.wasm": "head",
+		"/{runtime}/{org}/{repo}/{release}/{format}/files/{path}": "get",
+		"/api/runtimes":                  "get",
+		"/compat/{org}/{repo}/{release}": "get",
+		"/admin/warm":                    "post",
+		"/healthz":                       "get",
+	} {
+		if _, ok := doc.Paths[path][method]; !ok {
+			t.Errorf("document does not describe %s %s", method, path)
+		}
+	}
+
+	for _, r := range routes() {
+		path, _ := openAPIPath(r.Path)
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("route %s is missing from the document", r.Path)
+		}
+	}
+}
+
+func TestOpenAPIMarksAdminRoutes(t *testing.T) {
+	doc := openAPIDocument([]Route{
+		{Methods: []string{http.MethodGet}, Path: "/admin/stats", Admin: true, ContentType: "application/json", Response: Stats{}},
+	})
+
+	operation := doc["paths"].(object)["/admin/stats"].(object)["get"].(object)
+	if _, ok := operation["security"]; !ok {
+		t.Error("admin operation has no security requirement")
+	}
+
+	schema := operation["responses"].(object)["200"].(object)["content"].(object)["application/json"].(object)["schema"].(object)
+	properties := schema["properties"].(object)
+	if _, ok := properties["active_downloads"]; !ok {
+		t.Errorf("Stats schema = %v, want its json field names", properties)
+	}
+}
+
+func TestOpenAPIMatchesRouteTable(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	type operation struct {
+		RequestBody *struct {
+			Content map[string]json.RawMessage `json:"content"`
+		} `json:"requestBody"`
+		Responses map[string]json.RawMessage `json:"responses"`
+	}
+	var doc struct {
+		Paths map[string]map[string]operation `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json is not JSON: %v", err)
+	}
+
+	for _, r := range routes() {
+		path, _ := openAPIPath(r.Path)
+		for _, method := range r.Methods {
+			op, ok := doc.Paths[path][strings.ToLower(method)]
+			if !ok {
+				t.Errorf("document does not describe %s %s", method, path)
+				continue
+			}
+			if got := op.RequestBody != nil; got != (r.Request != nil) {
+				t.Errorf("%s %s documents a request body: %v, want %v", method, path, got, r.Request != nil)
+			}
+			if op.RequestBody != nil && op.RequestBody.Content["application/json"] == nil {
+				t.Errorf("%s %s request body has no JSON schema", method, path)
+			}
+		}
+	}
+
+	// The admin routes that take a body answer with what they document.
+	for _, tc := range []struct{ method, path, body string }{
+		{http.MethodPost, "/admin/warm", `{}`},
+		{http.MethodPost, "/admin/pins", `{}`},
+		{http.MethodDelete, "/admin/pins", `{}`},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if _, ok := doc.Paths[tc.path][strings.ToLower(tc.method)].Responses[strconv.Itoa(rec.Code)]; !ok {
+			t.Errorf("%s %s = %d, which the document does not list", tc.method, tc.path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type PinRequest struct {
+	Runtimes []string     `json:"runtimes"`
+	Bundles  []WarmBundle `json:"bundles"`
+}
+
+func applyPins(ctx context.Context, req PinRequest, pinned bool) {
+	for _, runtime := range req.Runtimes {
+		key := cacheKey(ctx, runtime)
+		if pinned {
+			cache.runtimes.pin(key)
+		} else {
+			cache.runtimes.unpin(key)
+		}
+	}
+
+	for _, b := range req.Bundles {
+		key := cacheKey(ctx, bundleURL(b.Organization, b.Repository, b.Release))
+		if pinned {
+			cache.bundles.pin(key)
+		} else {
+			cache.bundles.unpin(key)
+		}
+	}
+}
+
+// parseBundleSpec reads "org/repo/release".
+func parseBundleSpec(spec string) (WarmBundle, bool) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return WarmBundle{}, false
+	}
+	return WarmBundle{Organization: parts[0], Repository: parts[1], Release: parts[2]}, true
+}
+
+// loadPins reads PINNED_RUNTIMES ("1.0.0,1.1.0") and PINNED_BUNDLES
+// ("org/repo/release,...").
+func loadPins() {
+	req := PinRequest{}
+
+	for _, runtime := range strings.Split(os.Getenv("PINNED_RUNTIMES"), ",") {
+		if runtime = strings.TrimSpace(runtime); runtime != "" {
+			req.Runtimes = append(req.Runtimes, runtime)
+		}
+	}
+
+	for _, spec := range strings.Split(os.Getenv("PINNED_BUNDLES"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		bundle, ok := parseBundleSpec(spec)
+		if !ok {
+			slog.Warn("ignoring invalid pinned bundle", "value", spec)
+			continue
+		}
+		req.Bundles = append(req.Bundles, bundle)
+	}
+
+	applyPins(context.Background(), req, true)
+}
+
+func pinHandler(c echo.Context) error {
+	req := PinRequest{}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid pin request")
+	}
+
+	for _, b := range req.Bundles {
+		if b.Organization == "" || b.Repository == "" || b.Release == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "bundles require org, repo and release")
+		}
+	}
+
+	applyPins(c.Request().Context(), req, c.Request().Method != http.MethodDelete)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// provider knows where a release asset can be downloaded from, how to
+// authenticate against that host and how to list its releases, which is what
+// "latest", the release listings, changelogs and asset resolution build on.
+type provider interface {
+	// assetURL is the canonical public URL of an asset, also used as its
+	// cache key.
+	assetURL(org, repo, tag, asset string) string
+	// downloadURL is where the asset is actually fetched from, which for a
+	// private GitHub repository is the API's asset endpoint.
+	downloadURL(ctx context.Context, org, repo, tag, asset string) (string, error)
+	authorize(req *http.Request)
+	// releases lists a repository's releases, or fails with
+	// errNoReleaseListing where the host has no such index.
+	releases(ctx context.Context, org, repo string) ([]Release, error)
+	release(ctx context.Context, org, repo, tag string) (Release, error)
+}
+
+// currentProvider reads UPSTREAM_PROVIDER: "github" (the default), "gitlab"
+// or "mirror".
+func currentProvider() provider {
+	switch os.Getenv("UPSTREAM_PROVIDER") {
+	case "gitlab":
+		return gitlabProvider{base: strings.TrimSuffix(envString("GITLAB_URL", "https://gitlab.com"), "/"), token: os.Getenv("GITLAB_TOKEN")}
+	case "mirror":
+		return mirrorProvider{base: strings.TrimSuffix(os.Getenv("MIRROR_URL"), "/"), token: os.Getenv("MIRROR_TOKEN")}
+	default:
+		return githubProvider{
+			base:    githubURL(),
+			api:     envString("GITHUB_API_URL", "https://api.github.com"),
+			token:   os.Getenv("GITHUB_TOKEN"),
+			private: envBool("GITHUB_PRIVATE", false),
+		}
+	}
+}
+
+func sameHost(u *url.URL, base string) bool {
+	b, err := url.Parse(base)
+	return err == nil && strings.EqualFold(u.Host, b.Host)
+}
+
+type githubProvider struct {
+	base, api, token string
+	private          bool
+}
+
+func (p githubProvider) assetURL(org, repo, tag, asset string) string {
+	return fmt.Sprintf("%s/%s/%s/releases/download/%s/%s", p.base, org, repo, tag, asset)
+}
+
+func (p githubProvider) downloadURL(ctx context.Context, org, repo, tag, asset string) (string, error) {
+	if !p.private {
+		return p.assetURL(org, repo, tag, asset), nil
+	}
+	return resolveAsset(ctx, org, repo, tag, regexp.MustCompile("^"+regexp.QuoteMeta(asset)+"$"), true)
+}
+
+func (p githubProvider) authorize(req *http.Request) {
+	if p.token == "" {
+		return
+	}
+
+	switch {
+	case sameHost(req.URL, p.api):
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		if strings.Contains(req.URL.Path, "/releases/assets/") {
+			req.Header.Set("Accept", "application/octet-stream")
+		}
+	case p.private && sameHost(req.URL, p.base):
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+}
+
+func (githubProvider) releases(ctx context.Context, org, repo string) ([]Release, error) {
+	var releases []Release
+	if err := githubAPI(ctx, fmt.Sprintf("/repos/%s/%s/releases?per_page=100", org, repo), mediaJSON, &releases); err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+func (githubProvider) release(ctx context.Context, org, repo, tag string) (Release, error) {
+	var release Release
+	if err := githubAPI(ctx, fmt.Sprintf("/repos/%s/%s/releases/tags/%s", org, repo, tag), mediaFull, &release); err != nil {
+		return Release{}, err
+	}
+	return release, nil
+}
+
+// gitlabProvider uses release asset permalinks, which GitLab redirects to
+// wherever the asset link points.
+type gitlabProvider struct {
+	base, token string
+}
+
+func (p gitlabProvider) assetURL(org, repo, tag, asset string) string {
+	return fmt.Sprintf("%s/%s/%s/-/releases/%s/downloads/%s", p.base, org, repo, url.PathEscape(tag), asset)
+}
+
+func (p gitlabProvider) downloadURL(_ context.Context, org, repo, tag, asset string) (string, error) {
+	return p.assetURL(org, repo, tag, asset), nil
+}
+
+func (p gitlabProvider) authorize(req *http.Request) {
+	if p.token != "" && sameHost(req.URL, p.base) {
+		req.Header.Set("PRIVATE-TOKEN", p.token)
+	}
+}
+
+type gitlabRelease struct {
+	TagName         string    `json:"tag_name"`
+	Description     string    `json:"description"`
+	DescriptionHTML string    `json:"description_html"`
+	Upcoming        bool      `json:"upcoming_release"`
+	ReleasedAt      time.Time `json:"released_at"`
+	Assets          struct {
+		Links []struct {
+			Name      string `json:"name"`
+			URL       string `json:"url"`
+			DirectURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+func (r gitlabRelease) release() Release {
+	release := Release{
+		TagName:     r.TagName,
+		Prerelease:  r.Upcoming,
+		Body:        r.Description,
+		BodyHTML:    r.DescriptionHTML,
+		PublishedAt: r.ReleasedAt,
+	}
+	for _, link := range r.Assets.Links {
+		u := link.DirectURL
+		if u == "" {
+			u = link.URL
+		}
+		release.Assets = append(release.Assets, Asset{Name: link.Name, URL: u, DownloadURL: u})
+	}
+	return release
+}
+
+// api fetches path under /api/v4/projects, cached and coalesced like the
+// GitHub API.
+func (p gitlabProvider) api(ctx context.Context, path string, v any) error {
+	u := p.base + "/api/v4/projects/" + path
+	body, err := cachedResponse(ctx, "gitlab "+u, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("http request error: %w", err)
+		}
+
+		resp, err := doUpstream(req)
+		if err != nil {
+			return nil, fmt.Errorf("http get error: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if err := upstreamStatus(resp); err != nil {
+			return nil, fmt.Errorf("gitlab api error: %w", err)
+		}
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decode response error: %w", err)
+	}
+	return nil
+}
+
+func (p gitlabProvider) releases(ctx context.Context, org, repo string) ([]Release, error) {
+	var releases []gitlabRelease
+	if err := p.api(ctx, url.PathEscape(org+"/"+repo)+"/releases?per_page=100", &releases); err != nil {
+		return nil, err
+	}
+
+	out := make([]Release, 0, len(releases))
+	for _, r := range releases {
+		out = append(out, r.release())
+	}
+	return out, nil
+}
+
+func (p gitlabProvider) release(ctx context.Context, org, repo, tag string) (Release, error) {
+	var release gitlabRelease
+	if err := p.api(ctx, url.PathEscape(org+"/"+repo)+"/releases/"+url.PathEscape(tag)+"?include_html_description=true", &release); err != nil {
+		return Release{}, err
+	}
+	return release.release(), nil
+}
+
+// mirrorProvider serves assets from a plain HTTP tree laid out as
+// MIRROR_URL/org/repo/tag/asset.
+type mirrorProvider struct {
+	base, token string
+}
+
+func (p mirrorProvider) assetURL(org, repo, tag, asset string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", p.base, org, repo, tag, asset)
+}
+
+func (p mirrorProvider) downloadURL(_ context.Context, org, repo, tag, asset string) (string, error) {
+	return p.assetURL(org, repo, tag, asset), nil
+}
+
+func (p mirrorProvider) authorize(req *http.Request) {
+	if p.token != "" && sameHost(req.URL, p.base) {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+}
+
+// A mirror is a bare file tree with no release index, so nothing can be
+// listed or resolved through it; explicit versions still work.
+func (mirrorProvider) releases(context.Context, string, string) ([]Release, error) {
+	return nil, errNoReleaseListing
+}
+
+func (mirrorProvider) release(context.Context, string, string, string) (Release, error) {
+	return Release{}, errNoReleaseListing
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitLabProvider(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('gitlab')", "carimbo.wasm", "\x00asm gitlab")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "glpat" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/flippingpixels/carimbo/-/releases/v9.504.0/downloads/WebAssembly.zip":
+			w.Write(runtimeZip)
+		case "/api/v4/projects/flippingpixels%2Fcarimbo/releases":
+			io.WriteString(w, `[{"tag_name":"v9.504.0"},{"tag_name":"v9.504.3","upcoming_release":true}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	cache.runtimes.purge("9.504.0")
+	t.Setenv("UPSTREAM_PROVIDER", "gitlab")
+	t.Setenv("GITLAB_URL", upstream.URL)
+	t.Setenv("GITLAB_TOKEN", "glpat")
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.504.0/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log('gitlab')" {
+		t.Errorf("GET carimbo.js from GitLab = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/runtimes", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"version":"9.504.0"`) || strings.Contains(rec.Body.String(), "9.504.3") {
+		t.Errorf("GET /api/runtimes from GitLab = %d: %s, want 9.504.0 without the upcoming release", rec.Code, rec.Body)
+	}
+}
+
+func TestMirrorProvider(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('mirror')", "carimbo.wasm", "\x00asm mirror")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mirrored" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/flippingpixels/carimbo/v9.504.1/WebAssembly.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	cache.runtimes.purge("9.504.1")
+	t.Setenv("UPSTREAM_PROVIDER", "mirror")
+	t.Setenv("MIRROR_URL", upstream.URL+"/")
+	t.Setenv("MIRROR_TOKEN", "mirrored")
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.504.1/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log('mirror')" {
+		t.Errorf("GET carimbo.js from the mirror = %d: %s", rec.Code, rec.Body)
+	}
+
+	// A mirror has no release index to list or resolve latest from.
+	for _, path := range []string{"/api/runtimes", "/latest/o/r/1.0.0/720p"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s from the mirror = %d, want 501", path, rec.Code)
+		}
+	}
+}
+
+func TestPrivateGitHubAssetsDownloadThroughTheAPI(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('private')", "carimbo.wasm", "\x00asm private")
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghp_private" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/repos/flippingpixels/carimbo/releases/tags/v9.504.2":
+			fmt.Fprintf(w, `{"tag_name":"v9.504.2","assets":[{"name":"WebAssembly.zip","url":"%s/repos/flippingpixels/carimbo/releases/assets/42"}]}`, upstream.URL)
+		case "/repos/flippingpixels/carimbo/releases/assets/42":
+			if r.Header.Get("Accept") != "application/octet-stream" {
+				io.WriteString(w, `{"id":42}`)
+				return
+			}
+			w.Write(runtimeZip)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	cache.runtimes.purge("9.504.2")
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("GITHUB_TOKEN", "ghp_private")
+	t.Setenv("GITHUB_PRIVATE", "true")
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("ASSET_URL_TTL", "1ns")
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.504.2/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log('private')" {
+		t.Errorf("GET carimbo.js from a private repository = %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// purgeRuntime and purgeBundle drop an entry from memory and from the disk
+// cache, so the next request fetches it again from upstream.
+func purgeRuntime(ctx context.Context, version string) bool {
+	purged := cache.runtimes.purge(cacheKey(ctx, version))
+	if disk != nil {
+		if url, err := runtimeURL(ctx, version); err == nil {
+			disk.Remove(cacheKey(ctx, url))
+		}
+	}
+	return purged
+}
+
+func purgeBundle(ctx context.Context, b WarmBundle) bool {
+	purged := cache.bundles.purge(cacheKey(ctx, bundleURL(b.Organization, b.Repository, b.Release)))
+	if disk != nil {
+		if url, err := bundleDownloadURL(ctx, b.Organization, b.Repository, b.Release); err == nil {
+			disk.Remove(cacheKey(ctx, url))
+		}
+	}
+	return purged
+}
+
+// purgeHandler serves DELETE /admin/cache/runtime/<version> and
+// DELETE /admin/cache/bundle/<org>/<repo>/<release>.
+func purgeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	kind, key, _ := strings.Cut(c.Param("*"), "/")
+	var purged bool
+	switch kind {
+	case "runtime":
+		if key == "" || strings.Contains(key, "/") {
+			return echo.NewHTTPError(http.StatusBadRequest, "expected runtime/<version>")
+		}
+		purged = purgeRuntime(ctx, key)
+	case "bundle":
+		b, ok := parseBundleSpec(key)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "expected bundle/<org>/<repo>/<release>")
+		}
+		purged = purgeBundle(ctx, b)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown cache kind")
+	}
+
+	if !purged {
+		return echo.NewHTTPError(http.StatusNotFound, "entry not cached")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
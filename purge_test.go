@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAdminPurgeRefetchesFromUpstream(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('purge')", "carimbo.wasm", "\x00asm purge")
+	bundle := sevenZipArchive(t, "main.lua", "print('purge')")
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/flippingpixels/carimbo/releases/download/v9.506.0/WebAssembly.zip":
+			w.Write(runtimeZip)
+		case "/o/purged/releases/download/v1.0.0/bundle.7z":
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("CACHE_DIR", t.TempDir())
+	t.Cleanup(func() { disk = nil })
+	cache.runtimes.purge("9.506.0")
+	cache.bundles.purge(bundleURL("o", "purged", "1.0.0"))
+	e := newServer()
+
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	fetch := func() {
+		t.Helper()
+		if rec := serve(http.MethodGet, "/9.506.0/o/purged/1.0.0/720p/carimbo.js", ""); rec.Code != http.StatusOK {
+			t.Fatalf("GET carimbo.js = %d: %s", rec.Code, rec.Body)
+		}
+		if rec := serve(http.MethodGet, "/9.506.0/o/purged/1.0.0/720p/bundle.7z", ""); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), bundle) {
+			t.Fatalf("GET bundle.7z = %d: %s", rec.Code, rec.Body)
+		}
+	}
+	upstreamHits := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits["/flippingpixels/carimbo/releases/download/v9.506.0/WebAssembly.zip"], hits["/o/purged/releases/download/v1.0.0/bundle.7z"]
+	}
+
+	fetch()
+	fetch()
+	if runtimes, bundles := upstreamHits(); runtimes != 1 || bundles != 1 {
+		t.Fatalf("upstream hits before purging = %d runtime, %d bundle, want 1 each", runtimes, bundles)
+	}
+
+	for _, tc := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/admin/cache/runtime/9.506.0", "wrong", http.StatusUnauthorized},
+		{"/admin/cache/runtime/9.506.0", "secret", http.StatusNoContent},
+		{"/admin/cache/runtime/9.506.0", "secret", http.StatusNotFound},
+		{"/admin/cache/bundle/o/purged/1.0.0", "secret", http.StatusNoContent},
+		{"/admin/cache/bundle/o/purged", "secret", http.StatusBadRequest},
+		{"/admin/cache/runtime/9.506.0/extra", "secret", http.StatusBadRequest},
+		{"/admin/cache/index/9.506.0", "secret", http.StatusBadRequest},
+	} {
+		if rec := serve(http.MethodDelete, tc.path, tc.token); rec.Code != tc.want {
+			t.Errorf("DELETE %s = %d, want %d: %s", tc.path, rec.Code, tc.want, rec.Body)
+		}
+	}
+
+	// The purge reaches the disk cache too, so both come from upstream again.
+	fetch()
+	if runtimes, bundles := upstreamHits(); runtimes != 2 || bundles != 2 {
+		t.Errorf("upstream hits after purging = %d runtime, %d bundle, want 2 each", runtimes, bundles)
+	}
+}
+
+func TestRequestsAreCountedAndLoggedByRoute(t *testing.T) {
+	logs := captureLogs(t)
+	t.Setenv("ACCESS_LOG", "true")
+	resetState(t)
+	e := newServer()
+
+	served := requests.WithLabelValues("/healthz", http.MethodGet, "200")
+	unmatched := requests.WithLabelValues("unmatched", http.MethodGet, "404")
+
+	for _, path := range []string{"/healthz", "/healthz", "/no/such/route/here/at/all/x"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := counterValue(t, served); got != 2 {
+		t.Errorf("GET /healthz counted %v times, want 2", got)
+	}
+	if got := counterValue(t, unmatched); got != 1 {
+		t.Errorf("unmatched request counted %v times, want 1 under the unmatched route", got)
+	}
+	if !strings.Contains(logs.String(), "path=/healthz route=/healthz status=200") {
+		t.Errorf("access log has no line for GET /healthz:\n%s", logs)
+	}
+
+	t.Setenv("ACCESS_LOG", "false")
+	e = newServer()
+	logs = captureLogs(t)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if strings.Contains(logs.String(), "path=/healthz") {
+		t.Errorf("ACCESS_LOG=false still logged the request:\n%s", logs)
+	}
+}
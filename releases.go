@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/mod/semver"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	runtimeOrganization = "flippingpixels"
+	runtimeRepository   = "carimbo"
+
+	latestAlias = "latest"
+
+	defaultTagPattern = `^v?\d+\.\d+\.\d+(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?$`
+)
+
+var (
+	errNoRelease        = errors.New("no matching release")
+	errNoAsset          = errors.New("no matching asset")
+	errNoReleaseListing = errors.New("upstream provider cannot list releases")
+)
+
+type Asset struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	DownloadURL string `json:"browser_download_url"`
+}
+
+type Release struct {
+	TagName     string    `json:"tag_name"`
+	Prerelease  bool      `json:"prerelease"`
+	Draft       bool      `json:"draft"`
+	Body        string    `json:"body"`
+	BodyHTML    string    `json:"body_html"`
+	PublishedAt time.Time `json:"published_at"`
+	Assets      []Asset   `json:"assets"`
+}
+
+type resolved struct {
+	value   string
+	expires time.Time
+}
+
+var tagPattern = regexp.MustCompile(defaultTagPattern)
+
+func loadTagPattern() error {
+	pattern := envString("RELEASE_TAG_PATTERN", defaultTagPattern)
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid RELEASE_TAG_PATTERN: %w", err)
+	}
+	tagPattern = re
+	return nil
+}
+
+var (
+	latestVersions sync.Map
+	assetURLs      sync.Map
+)
+
+func canonicalTag(tag string) string {
+	if strings.HasPrefix(tag, "v") {
+		return tag
+	}
+	return "v" + tag
+}
+
+// releaseTag applies a source's tag prefix policy to a requested version:
+// "always" (the default) forces a leading v, "never" strips it and
+// "as-given" uses the version verbatim.
+func releaseTag(policy, version string) string {
+	switch policy {
+	case "never":
+		return strings.TrimPrefix(version, "v")
+	case "as-given":
+		return version
+	default:
+		return "v" + strings.TrimPrefix(version, "v")
+	}
+}
+
+func isPrerelease(r Release) bool {
+	return r.Prerelease || semver.Prerelease(canonicalTag(r.TagName)) != ""
+}
+
+type apiResponse struct {
+	body    []byte
+	expires time.Time
+}
+
+// All releases API traffic funnels through githubAPI, which serves repeated
+// paths from memory for GITHUB_API_INTERVAL and collapses concurrent callers
+// into one request, keeping us well inside GitHub's rate limits.
+var (
+	apiResponses sync.Map
+	apiGroup     singleflight.Group
+)
+
+const (
+	mediaJSON = "application/vnd.github+json"
+	mediaFull = "application/vnd.github.full+json"
+)
+
+func doAPI(ctx context.Context, url, media, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request error: %w", err)
+	}
+	req.Header.Set("Accept", media)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := upstream.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http get error: %w", err)
+	}
+	return resp, nil
+}
+
+func fetchAPI(ctx context.Context, path, media string) ([]byte, error) {
+	url := envString("GITHUB_API_URL", "https://api.github.com") + path
+	token := envString("GITHUB_TOKEN", "")
+
+	resp, err := doAPI(ctx, url, media, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && token != "" && anonymousFallback() {
+		resp.Body.Close()
+		slog.Warn("GITHUB_TOKEN rejected, retrying anonymously", "path", path)
+		if resp, err = doAPI(ctx, url, media, ""); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if err := upstreamStatus(resp); err != nil {
+		return nil, fmt.Errorf("github api error: %w", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response error: %w", err)
+	}
+	return body, nil
+}
+
+func cachedAPI(ctx context.Context, path, media string) ([]byte, error) {
+	return cachedResponse(ctx, media+" "+path, func(ctx context.Context) ([]byte, error) {
+		return fetchAPI(ctx, path, media)
+	})
+}
+
+// cachedResponse serves key from memory for GITHUB_API_INTERVAL, and
+// otherwise runs fetch once for all concurrent callers.
+func cachedResponse(ctx context.Context, key string, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	if cached, ok := apiResponses.Load(key); ok && time.Now().Before(cached.(apiResponse).expires) {
+		return cached.(apiResponse).body, nil
+	}
+
+	// As with store.refresh, the shared call outlives whichever caller
+	// happened to start it.
+	results := apiGroup.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), envDuration("GITHUB_API_TIMEOUT", 30*time.Second))
+		defer cancel()
+
+		body, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		apiResponses.Store(key, apiResponse{body: body, expires: time.Now().Add(envDuration("GITHUB_API_INTERVAL", time.Minute))})
+		return body, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-results:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	}
+}
+
+func githubAPI(ctx context.Context, path, media string, v any) error {
+	body, err := cachedAPI(ctx, path, media)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decode response error: %w", err)
+	}
+	return nil
+}
+
+func listReleases(ctx context.Context, org, repo string) ([]Release, error) {
+	releases, err := currentProvider().releases(ctx, org, repo)
+	if err != nil {
+		return nil, fmt.Errorf("list releases error: %w", err)
+	}
+	return releases, nil
+}
+
+// newerRelease orders semver tags by precedence and anything else, such as
+// date-based tags a custom RELEASE_TAG_PATTERN admits, by publication time.
+func newerRelease(a, b Release) bool {
+	if at, bt := canonicalTag(a.TagName), canonicalTag(b.TagName); semver.IsValid(at) && semver.IsValid(bt) {
+		return semver.Compare(at, bt) > 0
+	}
+	if !a.PublishedAt.Equal(b.PublishedAt) {
+		return a.PublishedAt.After(b.PublishedAt)
+	}
+	return a.TagName > b.TagName
+}
+
+// releaseVersion is the version a tag is addressed by: semver tags lose
+// their v, which the tag prefix policy adds back, and others stay verbatim.
+func releaseVersion(tag string) string {
+	if semver.IsValid(canonicalTag(tag)) {
+		return strings.TrimPrefix(tag, "v")
+	}
+	return tag
+}
+
+// listedRelease reports whether r can be served and so belongs in latest
+// and the release listings.
+func listedRelease(r Release, prerelease bool) bool {
+	return !r.Draft && tagPattern.MatchString(releaseVersion(r.TagName)) && (prerelease || !isPrerelease(r))
+}
+
+func latestRelease(releases []Release, prerelease bool) (string, error) {
+	var best *Release
+	for i, r := range releases {
+		if !listedRelease(r, prerelease) {
+			continue
+		}
+		if best == nil || newerRelease(r, *best) {
+			best = &releases[i]
+		}
+	}
+
+	if best == nil {
+		return "", errNoRelease
+	}
+	return releaseVersion(best.TagName), nil
+}
+
+// latestRedirect follows github.com's /releases/latest redirect and reads the
+// tag off the final URL, which costs no API quota. GitHub only ever points it
+// at the newest stable release.
+func latestRedirect(ctx context.Context, org, repo string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("%s/%s/%s/releases/latest", githubURL(), org, repo), nil)
+	if err != nil {
+		return "", fmt.Errorf("http request error: %w", err)
+	}
+
+	resp, err := upstream.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http head error: %w", err)
+	}
+	resp.Body.Close()
+
+	if err := upstreamStatus(resp); err != nil {
+		return "", err
+	}
+
+	rest, ok := strings.CutPrefix(resp.Request.URL.Path, fmt.Sprintf("/%s/%s/releases/tag/", org, repo))
+	if !ok || rest == "" || strings.Contains(rest, "/") {
+		return "", fmt.Errorf("%s/%s: %w: redirected to %s", org, repo, errNoRelease, resp.Request.URL)
+	}
+	return strings.TrimPrefix(rest, "v"), nil
+}
+
+func resolveLatest(ctx context.Context, org, repo string, prerelease bool) (string, error) {
+	key := fmt.Sprintf("%s/%s/%t", org, repo, prerelease)
+	if cached, ok := latestVersions.Load(cacheKey(ctx, key)); ok && time.Now().Before(cached.(resolved).expires) {
+		return cached.(resolved).value, nil
+	}
+
+	var version string
+	if _, github := currentProvider().(githubProvider); github && !prerelease && envBool("LATEST_VIA_REDIRECT", false) {
+		var err error
+		if version, err = latestRedirect(ctx, org, repo); err != nil {
+			return "", fmt.Errorf("latest redirect error: %w", err)
+		}
+	} else {
+		releases, err := listReleases(ctx, org, repo)
+		if err != nil {
+			return "", err
+		}
+
+		if version, err = latestRelease(releases, prerelease); err != nil {
+			return "", fmt.Errorf("%s/%s: %w", org, repo, err)
+		}
+	}
+
+	latestVersions.Store(cacheKey(ctx, key), resolved{value: version, expires: time.Now().Add(envDuration("LATEST_TTL", 5*time.Minute))})
+	return version, nil
+}
+
+func assetPattern() (*regexp.Regexp, error) {
+	pattern := envString("RUNTIME_ASSET_PATTERN", "")
+	if pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RUNTIME_ASSET_PATTERN: %w", err)
+	}
+	return re, nil
+}
+
+// resolveAsset finds the first asset of a release whose name matches
+// pattern, returning its API endpoint rather than the browser URL when api is
+// set, as private repositories need.
+func resolveAsset(ctx context.Context, org, repo, tag string, pattern *regexp.Regexp, api bool) (string, error) {
+	key := fmt.Sprintf("%s/%s/%s/%s/%t", org, repo, tag, pattern, api)
+	if cached, ok := assetURLs.Load(cacheKey(ctx, key)); ok && time.Now().Before(cached.(resolved).expires) {
+		return cached.(resolved).value, nil
+	}
+
+	release, err := currentProvider().release(ctx, org, repo, tag)
+	if err != nil {
+		return "", fmt.Errorf("get release error: %w", err)
+	}
+
+	for _, asset := range release.Assets {
+		if pattern.MatchString(asset.Name) {
+			url := asset.DownloadURL
+			if api {
+				url = asset.URL
+			}
+			assetURLs.Store(cacheKey(ctx, key), resolved{value: url, expires: time.Now().Add(envDuration("ASSET_URL_TTL", time.Hour))})
+			return url, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s/%s %s: %w", org, repo, tag, errNoAsset)
+}
+
+func runtimeURL(ctx context.Context, runtime string) (string, error) {
+	pattern, err := assetPattern()
+	if err != nil {
+		return "", err
+	}
+
+	tag := releaseTag(os.Getenv("RUNTIME_TAG_PREFIX"), runtime)
+	if pattern == nil {
+		return currentProvider().downloadURL(ctx, runtimeOrganization, runtimeRepository, tag, "WebAssembly.zip")
+	}
+
+	return resolveAsset(ctx, runtimeOrganization, runtimeRepository, tag, pattern, envBool("GITHUB_PRIVATE", false))
+}
+
+func allowPrerelease(c echo.Context) bool {
+	if q := c.QueryParam("prerelease"); q != "" {
+		return q == "1" || q == "true"
+	}
+	return envBool("ALLOW_PRERELEASE", false)
+}
+
+func resolveParams(c echo.Context, p *Params) error {
+	if err := resolveRelease(c, p); err != nil {
+		return err
+	}
+
+	if p.Runtime == "" {
+		p.Runtime = envString("DEFAULT_RUNTIME", latestAlias)
+	}
+
+	if p.Runtime == latestAlias {
+		version, err := resolveLatest(c.Request().Context(), runtimeOrganization, runtimeRepository, allowPrerelease(c))
+		if err != nil {
+			return fetchError(fmt.Errorf("resolve runtime error: %w", err))
+		}
+		p.Runtime = version
+		c.Response().Header().Set("Cache-Control", cachePolicyDirective("alias"))
+	}
+
+	if !tagPattern.MatchString(p.Runtime) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid runtime tag: %s", p.Runtime))
+	}
+
+	return nil
+}
+
+// resolveRelease is the bundle half of resolveParams, for routes that never
+// touch a runtime.
+func resolveRelease(c echo.Context, p *Params) error {
+	// Empty segments only survive with CLEAN_PATHS off; catch them before
+	// they turn into pointless upstream URLs.
+	for _, segment := range []struct{ name, value string }{{"org", p.Organization}, {"repo", p.Repository}, {"release", p.Release}} {
+		if segment.value == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("missing %s in path", segment.name))
+		}
+	}
+
+	if p.Release == latestAlias {
+		version, err := resolveLatest(c.Request().Context(), p.Organization, p.Repository, allowPrerelease(c))
+		if err != nil {
+			return fetchError(fmt.Errorf("resolve release error: %w", err))
+		}
+		p.Release = version
+		c.Response().Header().Set("Cache-Control", cachePolicyDirective("alias"))
+	}
+
+	if !tagPattern.MatchString(p.Release) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid release tag: %s", p.Release))
+	}
+
+	return nil
+}
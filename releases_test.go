@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatestReleasePrereleases(t *testing.T) {
+	releases := []Release{
+		{TagName: "v1.2.0"},
+		{TagName: "v1.3.0-beta.1"},
+		{TagName: "v1.2.5", Prerelease: true},
+		{TagName: "v1.1.0"},
+		{TagName: "v2.0.0", Draft: true},
+	}
+
+	for _, tc := range []struct {
+		prerelease bool
+		want       string
+	}{
+		{false, "1.2.0"},
+		{true, "1.3.0-beta.1"},
+	} {
+		got, err := latestRelease(releases, tc.prerelease)
+		if err != nil {
+			t.Fatalf("latestRelease(prerelease=%t): %v", tc.prerelease, err)
+		}
+		if got != tc.want {
+			t.Errorf("latestRelease(prerelease=%t) = %s, want %s", tc.prerelease, got, tc.want)
+		}
+	}
+
+	if _, err := latestRelease([]Release{{TagName: "v1.0.0-rc.1"}}, false); !errors.Is(err, errNoRelease) {
+		t.Errorf("latestRelease with only prereleases = %v, want errNoRelease", err)
+	}
+}
+
+func TestLatestAliasPrereleaseSetting(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/prerelease/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `[{"tag_name":"v1.0.0"},{"tag_name":"v1.1.0-rc.1"}]`)
+	}))
+	defer api.Close()
+
+	t.Setenv("GITHUB_API_URL", api.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("LATEST_TTL", "1ns")
+
+	for _, tc := range []struct {
+		allow, query, want string
+	}{
+		{"", "", "1.0.0"},
+		{"", "?prerelease=1", "1.1.0-rc.1"},
+		{"true", "", "1.1.0-rc.1"},
+		{"true", "?prerelease=0", "1.0.0"},
+	} {
+		t.Setenv("ALLOW_PRERELEASE", tc.allow)
+		e := newServer()
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.212.0/o/prerelease/latest/720p/launcher.js"+tc.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET launcher.js%s = %d: %s", tc.query, rec.Code, rec.Body)
+		}
+
+		want := `"/9.212.0/o/prerelease/` + tc.want + `/720p/bundle.7z"`
+		if body := rec.Body.String(); !strings.Contains(body, want) {
+			t.Errorf("ALLOW_PRERELEASE=%q %s resolved latest to something else than %s:\n%s", tc.allow, tc.query, tc.want, body)
+		}
+	}
+}
+
+func TestRuntimeAssetResolvedThroughAPI(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('renamed')", "carimbo.wasm", "\x00asm renamed")
+
+	var releaseLookups atomic.Int64
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/flippingpixels/carimbo/releases/tags/v9.241.0":
+			releaseLookups.Add(1)
+			fmt.Fprintf(w, `{"tag_name":"v9.241.0","assets":[
+				{"name":"checksums.txt","browser_download_url":"%[1]s/dl/checksums.txt"},
+				{"name":"carimbo-web-9.241.0.zip","browser_download_url":"%[1]s/dl/carimbo-web-9.241.0.zip"}
+			]}`, upstream.URL)
+		case "/dl/carimbo-web-9.241.0.zip":
+			w.Write(runtimeZip)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1ns")
+	t.Setenv("RUNTIME_ASSET_PATTERN", `^carimbo-web-.*\.zip$`)
+	resetState(t)
+	e := newServer()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.241.0/o/r/1.0.0/720p/carimbo.js", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log('renamed')" {
+		t.Fatalf("GET carimbo.js = %d %q, want the script from the renamed asset", rec.Code, rec.Body)
+	}
+
+	url, err := runtimeURL(context.Background(), "9.241.0")
+	if err != nil {
+		t.Fatalf("runtimeURL: %v", err)
+	}
+	if url != upstream.URL+"/dl/carimbo-web-9.241.0.zip" {
+		t.Errorf("runtimeURL = %s, want the matching asset's download URL", url)
+	}
+	if n := releaseLookups.Load(); n != 1 {
+		t.Errorf("release looked up %d times, want the resolved URL cached", n)
+	}
+
+	t.Setenv("RUNTIME_ASSET_PATTERN", `^nothing-matches$`)
+	if _, err := runtimeURL(context.Background(), "9.241.0"); !errors.Is(err, errNoAsset) {
+		t.Errorf("runtimeURL with no matching asset = %v, want errNoAsset", err)
+	}
+}
+
+func TestCustomReleaseTagPattern(t *testing.T) {
+	previous := tagPattern
+	t.Cleanup(func() { tagPattern = previous })
+
+	e := newServer()
+	path := "/9.243.0/o/r/2024-05-01/720p"
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("GET a date-tagged release under the semver default = %d, want 400", rec.Code)
+	}
+
+	t.Setenv("RELEASE_TAG_PATTERN", `^(?:v?\d+\.\d+\.\d+|\d{4}-\d{2}-\d{2})$`)
+	if err := loadTagPattern(); err != nil {
+		t.Fatalf("loadTagPattern: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET a date-tagged release under a date pattern = %d: %s", rec.Code, rec.Body)
+	}
+
+	latest, err := latestRelease([]Release{
+		{TagName: "2024-05-01", PublishedAt: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{TagName: "2024-06-12", PublishedAt: time.Date(2024, 6, 12, 0, 0, 0, 0, time.UTC)},
+		{TagName: "nightly", PublishedAt: time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+	}, false)
+	if err != nil || latest != "2024-06-12" {
+		t.Errorf("latestRelease of date tags = %q %v, want 2024-06-12", latest, err)
+	}
+
+	t.Setenv("RELEASE_TAG_PATTERN", `^(unclosed`)
+	if err := loadTagPattern(); err == nil {
+		t.Error("loadTagPattern accepted a pattern that does not compile")
+	}
+}
+
+func TestReleasesAPIQueriedOncePerInterval(t *testing.T) {
+	var hits atomic.Int64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/polling/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, `[{"tag_name":"v2.0.0-rc.1"},{"tag_name":"v1.4.0"}]`)
+	}))
+	defer api.Close()
+
+	t.Setenv("GITHUB_API_URL", api.URL)
+	t.Setenv("GITHUB_API_INTERVAL", "1h")
+	t.Setenv("LATEST_TTL", "1ns")
+	resetState(t)
+	e := newServer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if releases, err := listReleases(context.Background(), "o", "polling"); err != nil || len(releases) != 2 {
+				t.Errorf("listReleases = %v %v", releases, err)
+			}
+		}()
+		go func(prerelease bool) {
+			defer wg.Done()
+			if _, err := resolveLatest(context.Background(), "o", "polling", prerelease); err != nil {
+				t.Errorf("resolveLatest(prerelease=%t): %v", prerelease, err)
+			}
+		}(i%2 == 0)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/o/polling/releases", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET /api/o/polling/releases = %d: %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := resolveLatest(context.Background(), "o", "polling", false); err != nil {
+		t.Fatalf("resolveLatest after the burst: %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("releases API hit %d times, want once within GITHUB_API_INTERVAL", n)
+	}
+}
+
+func TestReleaseTagPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy, version, want string
+	}{
+		{"", "1.2.3", "v1.2.3"},
+		{"always", "v1.2.3", "v1.2.3"},
+		{"never", "v1.2.3", "1.2.3"},
+		{"never", "1.2.3", "1.2.3"},
+		{"as-given", "1.2.3", "1.2.3"},
+		{"as-given", "v1.2.3", "v1.2.3"},
+	} {
+		if got := releaseTag(tc.policy, tc.version); got != tc.want {
+			t.Errorf("releaseTag(%q, %q) = %q, want %q", tc.policy, tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestUnprefixedTagsAreFetched(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('bare')", "carimbo.wasm", "\x00asm bare")
+	bundle := sevenZipArchive(t, "main.lua", "print('bare')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flippingpixels/carimbo/releases/download/9.257.0/WebAssembly.zip":
+			w.Write(runtimeZip)
+		case "/o/unprefixed/releases/download/1.0.0/bundle.7z":
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	t.Setenv("RUNTIME_TAG_PREFIX", "never")
+	t.Setenv("BUNDLE_TAG_PREFIX", "never")
+	e := newServer()
+
+	for _, path := range []string{"/9.257.0/o/unprefixed/1.0.0/720p/carimbo.js", "/9.257.0/o/unprefixed/1.0.0/720p/bundle.7z"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s with unprefixed tags = %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestLatestViaRedirect(t *testing.T) {
+	var apiHits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/o/redirect/releases/latest":
+			http.Redirect(w, r, "/o/redirect/releases/tag/v3.1.4", http.StatusFound)
+		case "/o/redirect/releases/tag/v3.1.4":
+			w.WriteHeader(http.StatusOK)
+		case "/o/nowhere/releases/latest":
+			http.Redirect(w, r, "/o/nowhere/releases", http.StatusFound)
+		case "/o/nowhere/releases":
+			w.WriteHeader(http.StatusOK)
+		default:
+			apiHits.Add(1)
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("GITHUB_API_URL", upstream.URL)
+	t.Setenv("LATEST_TTL", "1ns")
+	t.Setenv("LATEST_VIA_REDIRECT", "true")
+	e := newServer()
+
+	version, err := resolveLatest(context.Background(), "o", "redirect", false)
+	if err != nil || version != "3.1.4" {
+		t.Fatalf("resolveLatest = %q %v, want the tag the redirect landed on", version, err)
+	}
+	if n := apiHits.Load(); n != 0 {
+		t.Errorf("releases API hit %d times, want latest resolved from the redirect alone", n)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.275.0/o/redirect/latest/720p/launcher.js", nil))
+	if want := "/9.275.0/o/redirect/3.1.4/720p/bundle.7z"; rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("GET latest launcher.js = %d, want it to reference %s:\n%s", rec.Code, want, rec.Body)
+	}
+
+	if _, err := resolveLatest(context.Background(), "o", "nowhere", false); !errors.Is(err, errNoRelease) {
+		t.Errorf("resolveLatest for a repo without releases = %v, want errNoRelease", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+type Route struct {
+	Methods []string
+	Path    string
+	Handler echo.HandlerFunc
+	Policy  string
+	Admin   bool
+	// TokenQuery also accepts the admin token as ?token=, for pages opened
+	// from a plain browser tab.
+	TokenQuery  bool
+	Summary     string
+	ContentType string
+	// Status is the success status when it isn't 200, or 204 without a
+	// ContentType.
+	Status   int
+	Request  any
+	Response any
+}
+
+var adminAuth = middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+	KeyLookup: "header:" + echo.HeaderAuthorization,
+	Validator: func(key string, c echo.Context) (bool, error) {
+		return validAdminToken(key), nil
+	},
+})
+
+// adminQueryAuth lets the status page be opened and refreshed from a plain
+// browser tab. Query strings end up in browser history and proxy logs, so
+// only read-only pages get it.
+var adminQueryAuth = middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+	KeyLookup: "header:" + echo.HeaderAuthorization + ",query:token",
+	Validator: func(key string, c echo.Context) (bool, error) {
+		return validAdminToken(key), nil
+	},
+})
+
+func validAdminToken(key string) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	return token != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1
+}
+
+const prefix = "/:runtime/:org/:repo/:release/:format"
+
+func routes() []Route {
+	get := []string{http.MethodGet}
+	// Echo answers OPTIONS itself with a 204 and an Allow header built from
+	// the methods registered here, so assets list HEAD alongside GET.
+	asset := []string{http.MethodGet, http.MethodHead}
+
+	return []Route{
+		{Methods: []string{http.MethodGet, http.MethodHead}, Path: prefix, Handler: indexHandler, Policy: "page", Summary: "Playground page", ContentType: echo.MIMETextHTML},
+		{Methods: asset, Path: prefix + "/carimbo.js", Handler: javaScriptHandler, Policy: "immutable", Summary: "Runtime loader script", ContentType: "application/javascript"},
+		{Methods: asset, Path: prefix + "/carimbo.wasm", Handler: webAssemblyHandler, Policy: "wasm", Summary: "Runtime WebAssembly binary", ContentType: "application/wasm"},
+		{Methods: asset, Path: prefix + "/bundle.7z", Handler: bundleHandler, Policy: "immutable", Summary: "Game bundle", ContentType: "application/octet-stream"},
+		{Methods: asset, Path: prefix + "/launcher.js", Handler: launcherHandler, Policy: "immutable", Summary: "Bootstrap script wiring runtime and bundle", ContentType: "application/javascript"},
+		{Methods: asset, Path: prefix + "/bundle.tar.gz", Handler: tarGzHandler, Policy: "immutable", Summary: "Game bundle repackaged as tar.gz", ContentType: "application/gzip"},
+		{Methods: asset, Path: prefix + "/contents.json", Handler: contentsHandler, Policy: "immutable", Summary: "Bundle file listing", ContentType: echo.MIMEApplicationJSON, Response: []BundleEntry{}},
+		{Methods: asset, Path: prefix + "/manifest.json", Handler: manifestHandler, Policy: "immutable", Summary: "Preload manifest with sizes and SRI hashes", ContentType: echo.MIMEApplicationJSON, Response: []ManifestEntry{}},
+		{Methods: asset, Path: prefix + "/files/*", Handler: bundleFileHandler, Policy: "immutable", Summary: "Single file from the bundle", ContentType: echo.MIMEOctetStream},
+		{Methods: asset, Path: prefix + "/assets/*", Handler: assetsHandler(assets), Policy: "immutable", Summary: "Embedded playground asset", ContentType: echo.MIMEOctetStream},
+
+		{Methods: get, Path: "/favicon.ico", Handler: faviconHandler(assets), Policy: "html", Summary: "Favicon, or an empty response when none is embedded", ContentType: "image/x-icon"},
+		{Methods: get, Path: "/healthz", Handler: healthHandler, Policy: "none", Summary: "Liveness probe", ContentType: echo.MIMETextPlain},
+		{Methods: get, Path: "/readyz", Handler: readyHandler, Policy: "none", Summary: "Readiness probe", ContentType: echo.MIMETextPlain},
+		{Methods: get, Path: "/ready", Handler: readyHandler, Policy: "none", Summary: "Readiness probe", ContentType: echo.MIMETextPlain},
+		{Methods: get, Path: "/metrics", Handler: metricsHandler, Policy: "none", Summary: "Prometheus metrics", ContentType: echo.MIMETextPlain},
+		{Methods: get, Path: "/cache-stats", Handler: cacheStatsHandler, Policy: "none", Summary: "Cache counters in Prometheus text format", ContentType: echo.MIMETextPlain},
+		{Methods: get, Path: "/:org/:repo/:file", Handler: standaloneBundleHandler, Policy: "immutable", Summary: "Game bundle addressed as <release>.7z, without a runtime", ContentType: "application/octet-stream"},
+		{Methods: get, Path: "/cas-bundle/:file", Handler: casBundleHandler, Policy: "immutable", Summary: "Cached bundle addressed by its SHA-256", ContentType: echo.MIMEOctetStream},
+		{Methods: get, Path: "/changelog/:version", Handler: changelogHandler, Policy: "html", Summary: "Release notes for a runtime version", ContentType: "text/markdown"},
+		{Methods: get, Path: "/compat/:org/:repo/:release", Handler: compatHandler, Policy: "immutable", Summary: "Runtime requirement declared by a bundle", ContentType: echo.MIMEApplicationJSON, Response: Compat{}},
+		{Methods: get, Path: "/diff/:org/:repo/:from/:to", Handler: diffHandler, Policy: "immutable", Summary: "Files added, removed and changed between two bundle releases", ContentType: echo.MIMEApplicationJSON, Response: BundleDiff{}},
+		{Methods: get, Path: "/api/runtimes", Handler: runtimesHandler, Policy: "alias", Summary: "Runtime versions, newest first", ContentType: echo.MIMEApplicationJSON, Response: []ReleaseVersion{}},
+		{Methods: get, Path: "/api/:org/:repo/releases", Handler: releasesHandler, Policy: "alias", Summary: "Bundle release versions, newest first", ContentType: echo.MIMEApplicationJSON, Response: []ReleaseVersion{}},
+		{Methods: get, Path: "/openapi.json", Handler: openAPIHandler, Policy: "html", Summary: "This document", ContentType: echo.MIMEApplicationJSON},
+
+		{Methods: []string{http.MethodPost}, Path: "/admin/warm", Handler: warmHandler, Policy: "none", Admin: true, Summary: "Start a warm job", ContentType: echo.MIMEApplicationJSON, Status: http.StatusAccepted, Request: WarmRequest{}, Response: WarmStatus{}},
+		{Methods: get, Path: "/admin/warm/:id", Handler: warmStatusHandler, Policy: "none", Admin: true, Summary: "Warm job progress", ContentType: echo.MIMEApplicationJSON, Response: WarmStatus{}},
+		{Methods: []string{http.MethodPost, http.MethodDelete}, Path: "/admin/pins", Handler: pinHandler, Policy: "none", Admin: true, Summary: "Pin or unpin cache entries against eviction", Request: PinRequest{}},
+		{Methods: get, Path: "/status", Handler: statusHandler, Policy: "none", Admin: true, TokenQuery: true, Summary: "Auto-refreshing HTML status dashboard", ContentType: echo.MIMETextHTML},
+		{Methods: []string{http.MethodPost, http.MethodDelete}, Path: "/admin/maintenance", Handler: maintenanceHandler, Policy: "none", Admin: true, Summary: "Turn maintenance mode on (POST) or off (DELETE)"},
+		{Methods: []string{http.MethodDelete}, Path: "/admin/cache/*", Handler: purgeHandler, Policy: "none", Admin: true, Summary: "Purge runtime/<version> or bundle/<org>/<repo>/<release> from memory and disk"},
+		{Methods: get, Path: "/admin/stats", Handler: statsHandler, Policy: "none", Admin: true, Summary: "Cache and download statistics", ContentType: echo.MIMEApplicationJSON, Response: Stats{}},
+	}
+}
+
+func registerRoutes(e *echo.Echo) {
+	table := routes()
+	openAPI = openAPIDocument(table)
+
+	for _, r := range table {
+		middlewares := []echo.MiddlewareFunc{cachePolicy(r.Policy)}
+		if r.Admin && r.TokenQuery {
+			middlewares = append(middlewares, adminQueryAuth)
+		} else if r.Admin {
+			middlewares = append(middlewares, adminAuth)
+		}
+		e.Match(r.Methods, r.Path, r.Handler, middlewares...)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+var errOverloaded = errors.New("fetch queue full")
+
+type backgroundKey struct{}
+
+// withBackground marks fetches made under ctx, such as warm jobs and
+// prefetching, as background work for the fetch scheduler.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	background, _ := ctx.Value(backgroundKey{}).(bool)
+	return background
+}
+
+// fairScheduler hands out a fixed number of fetch slots. Waiters are queued
+// per key and served round-robin across keys, so a burst for one version
+// cannot starve fetches for another. Once queueLimit waiters are queued,
+// further callers are turned away with errOverloaded rather than left to
+// pile up.
+//
+// Background fetches wait in a queue of their own, hold at most
+// backgroundSlots of the slots at once, and only get a slot no live request
+// is waiting for.
+type fairScheduler struct {
+	slots           int
+	queueLimit      int
+	backgroundSlots int
+
+	mu         sync.Mutex
+	active     int
+	background int
+	queued     int
+	queues     map[string][]chan struct{}
+	order      []string
+	backlog    []chan struct{}
+}
+
+func newFairScheduler(slots, queueLimit, backgroundSlots int) *fairScheduler {
+	return &fairScheduler{slots: slots, queueLimit: queueLimit, backgroundSlots: max(backgroundSlots, 1), queues: make(map[string][]chan struct{})}
+}
+
+func (s *fairScheduler) acquire(ctx context.Context, key string) (func(), error) {
+	if s == nil || s.slots <= 0 {
+		return func() {}, nil
+	}
+
+	if isBackground(ctx) {
+		return s.acquireBackground(ctx)
+	}
+
+	s.mu.Lock()
+	if s.active < s.slots && len(s.order) == 0 {
+		s.active++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+
+	if s.queueLimit > 0 && s.queued >= s.queueLimit {
+		s.mu.Unlock()
+		return nil, errOverloaded
+	}
+
+	ready := make(chan struct{})
+	s.queued++
+	if len(s.queues[key]) == 0 {
+		s.order = append(s.order, key)
+	}
+	s.queues[key] = append(s.queues[key], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-ready:
+		s.handoff()
+	default:
+		s.dequeue(key, ready)
+	}
+	return nil, ctx.Err()
+}
+
+func (s *fairScheduler) acquireBackground(ctx context.Context) (func(), error) {
+	s.mu.Lock()
+	if s.active < s.slots && s.background < s.backgroundSlots && len(s.order) == 0 && len(s.backlog) == 0 {
+		s.active++
+		s.background++
+		s.mu.Unlock()
+		return s.releaseBackground, nil
+	}
+
+	ready := make(chan struct{})
+	s.backlog = append(s.backlog, ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.releaseBackground, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-ready:
+		s.background--
+		s.handoff()
+	default:
+		for i, ch := range s.backlog {
+			if ch == ready {
+				s.backlog = append(s.backlog[:i], s.backlog[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+func (s *fairScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handoff()
+}
+
+func (s *fairScheduler) releaseBackground() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.background--
+	s.handoff()
+}
+
+// handoff passes a finished slot to the next key in line, then to the next
+// background fetch if it is within its allowance, or frees it.
+func (s *fairScheduler) handoff() {
+	if len(s.order) == 0 {
+		if len(s.backlog) > 0 && s.background < s.backgroundSlots {
+			next := s.backlog[0]
+			s.backlog = s.backlog[1:]
+			s.background++
+			close(next)
+			return
+		}
+		s.active--
+		return
+	}
+
+	key := s.order[0]
+	s.order = s.order[1:]
+
+	queue := s.queues[key]
+	next := queue[0]
+	s.queued--
+	if len(queue) > 1 {
+		s.queues[key] = queue[1:]
+		s.order = append(s.order, key)
+	} else {
+		delete(s.queues, key)
+	}
+
+	close(next)
+}
+
+func (s *fairScheduler) dequeue(key string, ready chan struct{}) {
+	queue := s.queues[key]
+	for i, ch := range queue {
+		if ch == ready {
+			queue = append(queue[:i], queue[i+1:]...)
+			s.queued--
+			break
+		}
+	}
+
+	if len(queue) > 0 {
+		s.queues[key] = queue
+		return
+	}
+
+	delete(s.queues, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+var rewriteSlots = make(chan struct{}, max(envInt("REWRITE_CONCURRENCY", runtime.GOMAXPROCS(0)), 1))
+
+// acquireRewrite bounds CPU-heavy archive work (extraction, parsing and
+// precompression) independently of how many downloads are in flight.
+func acquireRewrite(ctx context.Context) (func(), error) {
+	select {
+	case rewriteSlots <- struct{}{}:
+		return func() { <-rewriteSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
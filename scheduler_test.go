@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// acquireAsync starts an acquire and reports its release once granted.
+func acquireAsync(ctx context.Context, s *fairScheduler, key string) <-chan func() {
+	granted := make(chan func(), 1)
+	go func() {
+		release, err := s.acquire(ctx, key)
+		if err == nil {
+			granted <- release
+		}
+	}()
+	return granted
+}
+
+func waitGranted(t *testing.T, granted <-chan func(), what string) func() {
+	t.Helper()
+
+	select {
+	case release := <-granted:
+		return release
+	case <-time.After(time.Second):
+		t.Fatalf("%s was never granted a slot", what)
+		return nil
+	}
+}
+
+func notGranted(t *testing.T, granted <-chan func(), what string) {
+	t.Helper()
+
+	select {
+	case <-granted:
+		t.Fatalf("%s was granted a slot", what)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestLiveFetchesAreNotBlockedByBackground(t *testing.T) {
+	s := newFairScheduler(2, 0, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	background := withBackground(ctx)
+
+	first := waitGranted(t, acquireAsync(background, s, "prefetch-0"), "the first prefetch")
+
+	// Each prefetch in the batch lets its slot go as soon as it gets one.
+	batch := make(chan func(), 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			if release, err := s.acquire(background, "prefetch"); err == nil {
+				release()
+				batch <- func() {}
+			}
+		}()
+	}
+	notGranted(t, batch, "a prefetch past the background allowance")
+
+	live := waitGranted(t, acquireAsync(ctx, s, "live-1"), "a live fetch beside the prefetch batch")
+
+	waiting := acquireAsync(ctx, s, "live-2")
+	notGranted(t, waiting, "a live fetch with every slot taken")
+
+	first()
+	waitGranted(t, waiting, "the live fetch waiting behind the prefetch batch")()
+	live()
+
+	// With no live fetch left, the batch drains.
+	for i := 0; i < 10; i++ {
+		waitGranted(t, batch, "a queued prefetch")
+	}
+}
+
+func TestFloodForOneVersionDoesNotStarveAnother(t *testing.T) {
+	s := newFairScheduler(1, 0, 1)
+	ctx := context.Background()
+	queued := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			s.mu.Lock()
+			got := s.queued
+			s.mu.Unlock()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d fetches queued, want %d", got, n)
+			}
+		}
+	}
+
+	type grant struct {
+		key     string
+		release func()
+	}
+	grants := make(chan grant, 32)
+	wait := func(key string) {
+		if release, err := s.acquire(ctx, key); err == nil {
+			grants <- grant{key, release}
+		}
+	}
+
+	holder := waitGranted(t, acquireAsync(ctx, s, "1.0.0"), "the first 1.0.0 fetch")
+	const flood = 20
+	for i := 0; i < flood; i++ {
+		go wait("1.0.0")
+	}
+	queued(flood)
+	go wait("2.0.0")
+	queued(flood + 1)
+
+	holder()
+	served := 0
+	for {
+		var g grant
+		select {
+		case g = <-grants:
+		case <-time.After(time.Second):
+			t.Fatalf("2.0.0 was never granted a slot, %d 1.0.0 fetches went first", served)
+		}
+		g.release()
+		if g.key == "2.0.0" {
+			break
+		}
+		served++
+	}
+	if served > 1 {
+		t.Errorf("2.0.0 got the slot after %d 1.0.0 fetches, want it served next in turn", served)
+	}
+
+	// Let the rest of the flood through so no waiter outlives the test.
+	for ; served < flood; served++ {
+		select {
+		case g := <-grants:
+			g.release()
+		case <-time.After(time.Second):
+			t.Fatalf("the flood stalled after %d fetches", served)
+		}
+	}
+}
+
+func TestRewritesNeverExceedTheCap(t *testing.T) {
+	previous := rewriteSlots
+	rewriteSlots = make(chan struct{}, 2)
+	t.Cleanup(func() { rewriteSlots = previous })
+
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireRewrite(context.Background())
+			if err != nil {
+				t.Errorf("acquireRewrite: %v", err)
+				return
+			}
+			defer release()
+
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if n := peak.Load(); n != 2 {
+		t.Errorf("peak concurrent rewrites = %d, want the cap of 2", n)
+	}
+
+	held := make([]func(), 0, 2)
+	for i := 0; i < 2; i++ {
+		release, _ := acquireRewrite(context.Background())
+		held = append(held, release)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireRewrite(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquireRewrite with every slot taken = %v, want the context's deadline", err)
+	}
+	for _, release := range held {
+		release()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	wasmMagic     = []byte("\x00asm")
+	sevenZipMagic = []byte("7z\xbc\xaf\x27\x1c")
+)
+
+type selfTestCheck struct {
+	path   string
+	verify func([]byte) error
+}
+
+func nonEmpty(body []byte) error {
+	if len(body) == 0 {
+		return errors.New("empty body")
+	}
+	return nil
+}
+
+func runSelfTest(e *echo.Echo) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("listen error: %w", err)
+	}
+
+	e.HideBanner = true
+	e.HidePort = true
+	e.Listener = ln
+	go func() {
+		if err := e.Start(""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Error(err)
+		}
+	}()
+	defer e.Close()
+
+	runtime := envString("SELFTEST_RUNTIME", latestAlias)
+	bundle, ok := parseBundleSpec(strings.Trim(os.Getenv("SELFTEST_BUNDLE"), "/"))
+	if !ok {
+		return errors.New("SELFTEST_BUNDLE must name a known bundle as org/repo/release")
+	}
+	prefix := fmt.Sprintf("http://%s/%s/%s/%s/%s/720p", ln.Addr(), runtime, bundle.Organization, bundle.Repository, bundle.Release)
+
+	checks := []selfTestCheck{
+		{path: prefix, verify: nonEmpty},
+		{path: prefix + "/carimbo.js", verify: nonEmpty},
+		{path: prefix + "/carimbo.wasm", verify: func(body []byte) error {
+			if !bytes.HasPrefix(body, wasmMagic) {
+				return errors.New("missing wasm magic")
+			}
+			return nil
+		}},
+		{path: prefix + "/bundle.7z", verify: func(body []byte) error {
+			if !bytes.HasPrefix(body, sevenZipMagic) {
+				return errors.New("missing 7z signature")
+			}
+			return nil
+		}},
+	}
+
+	client := &http.Client{Timeout: envDuration("SELFTEST_TIMEOUT", time.Minute)}
+	for _, check := range checks {
+		if err := selfTestFetch(client, check); err != nil {
+			return fmt.Errorf("%s: %w", check.path, err)
+		}
+	}
+
+	return nil
+}
+
+func selfTestFetch(client *http.Client, check selfTestCheck) error {
+	resp, err := client.Get(check.path)
+	if err != nil {
+		return fmt.Errorf("http get error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read all error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return check.verify(body)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestAgainstStubUpstream(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('selftest')", "carimbo.wasm", "\x00asm selftest")
+	bundle := sevenZipArchive(t, "main.lua", "print('selftest')")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flippingpixels/carimbo/releases/download/v9.222.0/WebAssembly.zip":
+			w.Write(runtimeZip)
+		case "/o/selftest/releases/download/v1.0.0/bundle.7z":
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("SELFTEST_RUNTIME", "9.222.0")
+
+	t.Setenv("SELFTEST_BUNDLE", "o/selftest/1.0.0")
+	if err := runSelfTest(newServer()); err != nil {
+		t.Fatalf("runSelfTest against a healthy stub: %v", err)
+	}
+
+	t.Setenv("SELFTEST_BUNDLE", "o/selftest/2.0.0")
+	err := runSelfTest(newServer())
+	if err == nil || !strings.Contains(err.Error(), "bundle.7z") {
+		t.Errorf("runSelfTest with a missing bundle = %v, want a bundle.7z failure", err)
+	}
+
+	t.Setenv("SELFTEST_BUNDLE", "o/selftest")
+	if err := runSelfTest(newServer()); err == nil {
+		t.Error("runSelfTest with a malformed SELFTEST_BUNDLE succeeded")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed status.html
+var statusPage string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusPage))
+
+type statusCache struct {
+	Kind                string
+	Hits, Misses, Stale int64
+	Ratio               float64
+	Entries             []cacheEntry
+}
+
+func newStatusCache(counters cacheCounters, entries []cacheEntry) statusCache {
+	sc := statusCache{Kind: counters.kind, Hits: counters.hits, Misses: counters.misses, Stale: counters.stale, Entries: entries}
+	if total := counters.hits + counters.misses; total > 0 {
+		sc.Ratio = 100 * float64(counters.hits) / float64(total)
+	}
+	return sc
+}
+
+func statusHandler(c echo.Context) error {
+	data := struct {
+		Now             time.Time
+		Refresh         int
+		ActiveDownloads int64
+		Caches          []statusCache
+		Failures        []failure
+	}{
+		Now:             time.Now(),
+		Refresh:         int(envDuration("STATUS_REFRESH", 5*time.Second).Seconds()),
+		ActiveDownloads: activeDownloads.Load(),
+		Caches: []statusCache{
+			newStatusCache(cache.runtimes.counters(), cache.runtimes.snapshot()),
+			newStatusCache(cache.bundles.counters(), cache.bundles.snapshot()),
+		},
+		Failures: failures.recent(),
+	}
+
+	var buf bytes.Buffer
+	if err := statusTemplate.Execute(&buf, data); err != nil {
+		return fmt.Errorf("execute template error: %w", err)
+	}
+
+	return c.HTMLBlob(http.StatusOK, buf.Bytes())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusPageShowsCacheAndErrors(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('status')", "carimbo.wasm", "\x00asm status")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/flippingpixels/carimbo/releases/download/v9.273.0/WebAssembly.zip" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("STATUS_REFRESH", "7s")
+	e := newServer()
+
+	for _, path := range []string{"/9.273.0/o/r/1.0.0/720p/carimbo.js", "/9.273.0/o/r/1.0.0/720p/carimbo.js", "/9.273.9/o/r/1.0.0/720p/carimbo.js"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status?token=wrong", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /status with a wrong admin token = %d, want 401", rec.Code)
+	}
+
+	// A browser tab passes the token in the query string.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status?token=secret", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /status = %d: %s", rec.Code, rec.Body)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`<meta http-equiv="refresh" content="7">`,
+		"Active downloads: 0.",
+		"<tr><td>runtime</td>",
+		"<tr><td>bundle</td>",
+		"<tr><td>9.273.0</td>",
+		"<td>/9.273.9/o/r/1.0.0/720p/carimbo.js</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status page does not contain %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestAdminTokenQueryOnlyOpensStatus(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+	logs := captureLogs(t)
+
+	// Elsewhere the query token is ignored, so the request is missing one.
+	for path, want := range map[string]int{
+		"/status?token=secret":       http.StatusOK,
+		"/admin/stats?token=secret":  http.StatusBadRequest,
+		"/admin/warm/x?token=secret": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	if out := logs.String(); strings.Contains(out, "secret") || !strings.Contains(out, "token=xxxxx") {
+		t.Errorf("access log does not redact the query token:\n%s", out)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type item[T any] struct {
+	key     string
+	value   T
+	fetched time.Time
+	ttl     time.Duration
+}
+
+type cacheTTLKey struct{}
+
+// withCacheTTL overrides CACHE_TTL for entries fetched under ctx.
+func withCacheTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheTTLKey{}, ttl)
+}
+
+func cacheTTL(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(cacheTTLKey{}).(time.Duration); ok {
+		return ttl
+	}
+	return envDuration("CACHE_TTL", 0)
+}
+
+type storeLimits struct {
+	entries int
+	bytes   int64
+}
+
+// store is an LRU keyed cache bounded by entry count and total size; a zero
+// limit leaves that dimension unbounded. Pinned keys are never evicted and do
+// not count towards either limit; neither do entries held by in-flight
+// responses until they are released.
+type store[T any] struct {
+	kind   string
+	hash   func(T) string
+	size   func(T) int64
+	limits storeLimits
+	group  singleflight.Group
+
+	// onEvict, when set, runs under s.mu for every entry that leaves the
+	// store other than by being refreshed with identical content.
+	onEvict func(key string, value T)
+
+	hits, misses, stale atomic.Int64
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	pinned  map[string]bool
+	readers map[string]int
+	bytes   int64
+}
+
+func newStore[T any](kind string, limits storeLimits, hash func(T) string, size func(T) int64) *store[T] {
+	return &store[T]{
+		kind:    kind,
+		hash:    hash,
+		size:    size,
+		limits:  limits,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		pinned:  make(map[string]bool),
+		readers: make(map[string]int),
+	}
+}
+
+func (s *store[T]) load(key string) (*item[T], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	s.order.MoveToFront(el)
+	return el.Value.(*item[T]), true
+}
+
+func (s *store[T]) store(key string, value T, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		if old := s.remove(el); s.onEvict != nil && s.hash(old.value) != s.hash(value) {
+			s.onEvict(old.key, old.value)
+		}
+	}
+	s.entries[key] = s.order.PushFront(&item[T]{key: key, value: value, fetched: time.Now(), ttl: ttl})
+	s.bytes += s.size(value)
+	s.evict()
+}
+
+// evict drops least recently used entries until the store is within its
+// limits. Pinned and held entries are skipped and, like in overLimit, don't
+// count; a held entry becomes evictable again once its last reader releases
+// it. The caller must hold s.mu.
+func (s *store[T]) evict() {
+	for reason := s.overLimit(); reason != ""; reason = s.overLimit() {
+		el := s.order.Back()
+		for el != nil && (s.pinned[el.Value.(*item[T]).key] || s.readers[el.Value.(*item[T]).key] > 0) {
+			el = el.Prev()
+		}
+		if el == nil {
+			return
+		}
+		s.evicted(s.remove(el), reason)
+	}
+}
+
+func (s *store[T]) evicted(it *item[T], reason string) {
+	if s.onEvict != nil {
+		s.onEvict(it.key, it.value)
+	}
+
+	size := s.size(it.value)
+	evictions.WithLabelValues(s.kind, reason).Inc()
+	if envBool("LOG_EVICTIONS", true) {
+		slog.Info("cache eviction", "kind", s.kind, "key", it.key, "size", size, "age", time.Since(it.fetched), "reason", reason)
+	}
+}
+
+// shed evicts least recently used entries, pinned and held ones aside, until
+// at least target bytes are freed or nothing evictable is left, and returns
+// how much it freed.
+func (s *store[T]) shed(target int64, reason string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var freed int64
+	for el := s.order.Back(); el != nil && freed < target; {
+		prev := el.Prev()
+		if key := el.Value.(*item[T]).key; !s.pinned[key] && s.readers[key] == 0 {
+			it := s.remove(el)
+			freed += s.size(it.value)
+			s.evicted(it, reason)
+		}
+		el = prev
+	}
+	return freed
+}
+
+// hold marks key as being served until the returned release is called.
+// Evicting it mid-response would not corrupt anything, since the bytes live on
+// until the last reader drops them, but they would no longer count towards the
+// byte budget and a new request would fetch a second copy.
+func (s *store[T]) hold(key string) func() {
+	s.mu.Lock()
+	s.readers[key]++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.readers[key]--; s.readers[key] == 0 {
+				delete(s.readers, key)
+			}
+			s.evict()
+		})
+	}
+}
+
+func (s *store[T]) remove(el *list.Element) *item[T] {
+	it := s.order.Remove(el).(*item[T])
+	delete(s.entries, it.key)
+	s.bytes -= s.size(it.value)
+	return it
+}
+
+// overLimit reports which limit the unpinned, unheld entries exceed: "entries"
+// or "bytes", or "" when within both.
+func (s *store[T]) overLimit() string {
+	entries, bytes := s.order.Len(), s.bytes
+	for key, el := range s.entries {
+		if s.pinned[key] || s.readers[key] > 0 {
+			entries--
+			bytes -= s.size(el.Value.(*item[T]).value)
+		}
+	}
+
+	switch {
+	case s.limits.entries > 0 && entries > s.limits.entries:
+		return "entries"
+	case s.limits.bytes > 0 && bytes > s.limits.bytes:
+		return "bytes"
+	}
+	return ""
+}
+
+// purge drops key regardless of pins or readers, reporting whether it was
+// cached.
+func (s *store[T]) purge(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	s.evicted(s.remove(el), "manual")
+	return true
+}
+
+func (s *store[T]) pin(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pinned[key] = true
+}
+
+func (s *store[T]) unpin(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pinned, key)
+}
+
+func (s *store[T]) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+type cacheEntry struct {
+	Key     string
+	Size    int64
+	Fetched time.Time
+	Pinned  bool
+}
+
+func (s *store[T]) snapshot() []cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]cacheEntry, 0, s.order.Len())
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		it := el.Value.(*item[T])
+		out = append(out, cacheEntry{Key: it.key, Size: s.size(it.value), Fetched: it.fetched, Pinned: s.pinned[it.key]})
+	}
+	return out
+}
+
+type cacheCounters struct {
+	kind                string
+	hits, misses, stale int64
+	entries             int
+}
+
+func (s *store[T]) counters() cacheCounters {
+	return cacheCounters{kind: s.kind, hits: s.hits.Load(), misses: s.misses.Load(), stale: s.stale.Load(), entries: s.len()}
+}
+
+func (s *store[T]) get(ctx context.Context, key string, fetch func(context.Context) (T, error)) (T, cacheStatus, error) {
+	cached, ok := s.load(key)
+	if !ok {
+		s.misses.Add(1)
+		return s.refresh(ctx, key, fetch)
+	}
+
+	ttl := cached.ttl
+	age := time.Since(cached.fetched)
+	if ttl <= 0 || age < ttl {
+		s.hits.Add(1)
+		return cached.value, cacheHit, nil
+	}
+
+	s.misses.Add(1)
+	value, status, err := s.refresh(ctx, key, fetch)
+	if err != nil && age < ttl+envDuration("STALE_IF_ERROR", time.Hour) {
+		slog.Warn("serving stale entry after failed refresh", "kind", s.kind, "key", key, "age", age, "error", err)
+		s.stale.Add(1)
+		return cached.value, cacheStale, nil
+	}
+
+	return value, status, err
+}
+
+// refresh collapses concurrent fetches of the same key into a single call, so
+// a burst of requests for a cold entry hits upstream once. The shared fetch
+// keeps the first caller's values but not its cancellation, bounded instead
+// by CACHE_FILL_TIMEOUT, so one client going away doesn't fail the others;
+// each caller still stops waiting when its own context ends.
+func (s *store[T]) refresh(ctx context.Context, key string, fetch func(context.Context) (T, error)) (T, cacheStatus, error) {
+	results := s.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), envDuration("CACHE_FILL_TIMEOUT", 10*time.Minute))
+		defer cancel()
+		return s.fetch(ctx, key, fetch)
+	})
+
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, cacheMiss, ctx.Err()
+	case res := <-results:
+		if res.Err != nil {
+			return zero, cacheMiss, res.Err
+		}
+		return res.Val.(T), cacheMiss, nil
+	}
+}
+
+func (s *store[T]) fetch(ctx context.Context, key string, fetch func(context.Context) (T, error)) (T, error) {
+	value, err := fetch(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if cached, ok := s.load(key); ok {
+		if prev, next := s.hash(cached.value), s.hash(value); prev == next {
+			value = cached.value
+		} else {
+			slog.Info("content changed", "kind", s.kind, "key", key, "old", prev, "new", next)
+			contentChanges.WithLabelValues(s.kind).Inc()
+		}
+	}
+
+	s.store(key, value, cacheTTL(ctx))
+	return value, nil
+}
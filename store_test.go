@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t testing.TB, c prometheus.Counter) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// resetState gives the test empty caches and release lookups and zeroed
+// counters, and puts the shared ones back once it is done, so tests neither
+// see each other's entries nor need versions of their own.
+func resetState(t testing.TB) {
+	t.Helper()
+
+	previousCache := cache
+	previousHTML, previousExhausted := upstreamHTML, upstreamExhausted
+	previousEvictions, previousChanges, previousRequests := evictions, contentChanges, requests
+
+	cache = newCache()
+	upstreamHTML = prometheus.NewCounter(prometheus.CounterOpts{Name: "play_upstream_html_total"})
+	upstreamExhausted = prometheus.NewCounter(prometheus.CounterOpts{Name: "play_upstream_retries_exhausted_total"})
+	evictions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "play_cache_evictions_total"}, []string{"kind", "reason"})
+	contentChanges = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "play_cache_content_changes_total"}, []string{"kind"})
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "play_http_requests_total"}, []string{"route", "method", "code"})
+	clearMaps()
+
+	t.Cleanup(func() {
+		cache = previousCache
+		upstreamHTML, upstreamExhausted = previousHTML, previousExhausted
+		evictions, contentChanges, requests = previousEvictions, previousChanges, previousRequests
+		clearMaps()
+	})
+}
+
+func clearMaps() {
+	for _, m := range []*sync.Map{&apiResponses, &assetURLs, &latestVersions} {
+		m.Range(func(key, _ any) bool {
+			m.Delete(key)
+			return true
+		})
+	}
+}
+
+func TestRefreshDetectsContentChangesOnce(t *testing.T) {
+	resetState(t)
+	s := newStore("runtime", storeLimits{}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	changes := contentChanges.WithLabelValues("runtime")
+	ctx := context.Background()
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetchHash := func(hash string, modified time.Time) func(context.Context) (Runtime, error) {
+		return func(context.Context) (Runtime, error) {
+			return Runtime{Hash: hash, Modified: modified}, nil
+		}
+	}
+
+	if _, _, err := s.refresh(ctx, "k", fetchHash("a", first)); err != nil {
+		t.Fatalf("initial fetch: %v", err)
+	}
+
+	same, _, err := s.refresh(ctx, "k", fetchHash("a", first.Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("identical refresh: %v", err)
+	}
+	if !same.Modified.Equal(first) {
+		t.Errorf("identical refresh changed Modified to %v, want %v kept", same.Modified, first)
+	}
+	if n := counterValue(t, changes); n != 0 {
+		t.Fatalf("content changes after identical refresh = %v, want 0", n)
+	}
+
+	changed, _, err := s.refresh(ctx, "k", fetchHash("b", first.Add(2*time.Hour)))
+	if err != nil {
+		t.Fatalf("changed refresh: %v", err)
+	}
+	if changed.Hash != "b" || !changed.Modified.Equal(first.Add(2*time.Hour)) {
+		t.Errorf("changed refresh = %+v, want the new content", changed)
+	}
+	if n := counterValue(t, changes); n != 1 {
+		t.Fatalf("content changes after changed refresh = %v, want 1", n)
+	}
+
+	if _, _, err := s.refresh(ctx, "k", fetchHash("b", first.Add(3*time.Hour))); err != nil {
+		t.Fatalf("repeat refresh: %v", err)
+	}
+	if n := counterValue(t, changes); n != 1 {
+		t.Fatalf("content changes after repeat refresh = %v, want still 1", n)
+	}
+}
+
+func TestStaleIfErrorServesExpiredEntry(t *testing.T) {
+	s := newStore("test-213", storeLimits{}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	s.store("k", Runtime{Hash: "cached"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	failing := func(context.Context) (Runtime, error) { return Runtime{}, errors.New("upstream down") }
+
+	value, status, err := s.get(context.Background(), "k", failing)
+	if err != nil {
+		t.Fatalf("get with failing refresh: %v", err)
+	}
+	if status != cacheStale || value.Hash != "cached" {
+		t.Fatalf("get = %+v %s, want the stale entry", value, status)
+	}
+
+	t.Setenv("STALE_IF_ERROR", "1ms")
+	if _, _, err := s.get(context.Background(), "k", failing); err == nil {
+		t.Fatal("get past the stale-if-error window succeeded, want the refresh error")
+	}
+}
+
+func TestStaleRuntimeResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	e := newServer()
+
+	script := []byte("console.log('stale')")
+	cache.runtimes.store("9.213.0", Runtime{Script: script, Binary: []byte("\x00asm"), Hash: contentHash(script)}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/9.213.0/o/r/1.0.0/720p/carimbo.js", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != string(script) {
+		t.Fatalf("GET carimbo.js = %d %q, want the stale script", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-Cache"); got != "STALE" {
+		t.Errorf("X-Cache = %q, want STALE", got)
+	}
+	if got := rec.Header().Get("Warning"); !strings.HasPrefix(got, "110") {
+		t.Errorf("Warning = %q, want a 110 stale warning", got)
+	}
+}
+
+func TestConcurrentColdRuntimeFetchesCollapse(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('once')", "carimbo.wasm", "\x00asm once")
+
+	var hits atomic.Int64
+	arrived := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		<-unblock
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	newServer()
+
+	cache.runtimes.purge("9.2512.0")
+	cache.runtimes.store("9.2512.1", Runtime{Hash: "warm"}, 0)
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := getRuntime(leaderCtx, "9.2512.0")
+		leader <- err
+	}()
+	select {
+	case <-arrived:
+	case err := <-leader:
+		t.Fatalf("leader getRuntime returned %v before reaching upstream", err)
+	}
+
+	const followers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < followers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime, _, err := getRuntime(context.Background(), "9.2512.0")
+			if err != nil || string(runtime.Script) != "console.log('once')" {
+				t.Errorf("follower getRuntime = %q %v, want the shared fetch", runtime.Script, err)
+			}
+		}()
+	}
+
+	// A cold fetch in flight holds up neither other runtimes nor the store.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, status, err := getRuntime(context.Background(), "9.2512.1"); err != nil || status != cacheHit {
+			t.Errorf("getRuntime of a cached runtime = %s %v, want a hit", status, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a cached runtime waited behind a cold fetch")
+	}
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled leader = %v, want context.Canceled", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hits = %d, want one for %d concurrent callers", n, followers+1)
+	}
+}
+
+func TestStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	resetState(t)
+	s := newStore("runtime", storeLimits{entries: 3}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	fetch := func(hash string) func(context.Context) (Runtime, error) {
+		return func(context.Context) (Runtime, error) { return Runtime{Hash: hash}, nil }
+	}
+	ctx := context.Background()
+	evicted := evictions.WithLabelValues("runtime", "entries")
+
+	for _, key := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		if _, _, err := s.get(ctx, key, fetch(key)); err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+	}
+
+	// A hit marks 1.0.0 recently used, leaving 1.1.0 the oldest.
+	if _, status, _ := s.get(ctx, "1.0.0", fetch("unused")); status != cacheHit {
+		t.Fatalf("get 1.0.0 = %s, want a hit", status)
+	}
+	if _, _, err := s.get(ctx, "1.3.0", fetch("1.3.0")); err != nil {
+		t.Fatalf("get 1.3.0: %v", err)
+	}
+
+	if n := s.len(); n != 3 {
+		t.Errorf("store holds %d entries, want the limit of 3", n)
+	}
+	for key, want := range map[string]bool{"1.0.0": true, "1.1.0": false, "1.2.0": true, "1.3.0": true} {
+		if _, ok := s.load(key); ok != want {
+			t.Errorf("%s cached = %t, want %t", key, ok, want)
+		}
+	}
+	if n := counterValue(t, evicted); n != 1 {
+		t.Errorf("entry evictions = %v, want 1", n)
+	}
+}
+
+func TestStoreEvictsBySize(t *testing.T) {
+	s := newStore("test-253-bytes", storeLimits{bytes: 10}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	for _, key := range []string{"a", "b", "c"} {
+		s.store(key, Runtime{Script: []byte("1234"), Hash: key}, 0)
+	}
+
+	if _, ok := s.load("a"); ok {
+		t.Error("oldest entry kept past the byte limit")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := s.load(key); !ok {
+			t.Errorf("%s evicted while within the byte limit", key)
+		}
+	}
+}
+
+func TestPinnedEntrySurvivesEviction(t *testing.T) {
+	s := newStore("test-264", storeLimits{entries: 2}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	s.pin("1.0.0")
+	s.store("1.0.0", Runtime{Script: []byte("lts"), Hash: "lts"}, 0)
+
+	for _, key := range []string{"1.1.0", "1.2.0", "1.3.0", "1.4.0"} {
+		s.store(key, Runtime{Script: []byte(key), Hash: key}, 0)
+	}
+	if _, ok := s.load("1.0.0"); !ok {
+		t.Fatal("pinned entry was evicted by the entry limit")
+	}
+	// The pinned entry sits outside the limit, which the newest two fill.
+	for key, want := range map[string]bool{"1.1.0": false, "1.2.0": false, "1.3.0": true, "1.4.0": true} {
+		if _, ok := s.load(key); ok != want {
+			t.Errorf("%s cached = %t, want %t", key, ok, want)
+		}
+	}
+
+	s.shed(1<<20, "memory")
+	if _, ok := s.load("1.0.0"); !ok {
+		t.Fatal("pinned entry was shed under memory pressure")
+	}
+	if n := s.len(); n != 1 {
+		t.Errorf("store holds %d entries after shedding, want only the pinned one", n)
+	}
+
+	// Pinning keeps an entry in memory, not frozen.
+	refreshed, _, err := s.refresh(context.Background(), "1.0.0", func(context.Context) (Runtime, error) {
+		return Runtime{Script: []byte("lts patched"), Hash: "lts-patched"}, nil
+	})
+	if err != nil || refreshed.Hash != "lts-patched" {
+		t.Fatalf("refresh of a pinned entry = %+v %v, want the new content", refreshed, err)
+	}
+
+	s.unpin("1.0.0")
+	for _, key := range []string{"1.5.0", "1.6.0"} {
+		s.store(key, Runtime{Script: []byte(key), Hash: key}, 0)
+	}
+	if _, ok := s.load("1.0.0"); ok {
+		t.Error("unpinned entry outlived the entry limit")
+	}
+}
+
+func TestAdminPinsEndpoint(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	pin := func(method string) int {
+		req := httptest.NewRequest(method, "/admin/pins", strings.NewReader(`{"runtimes":["9.264.0"],"bundles":[{"org":"o","repo":"r","release":"1.0.0"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	pinned := func() (bool, bool) {
+		cache.runtimes.mu.Lock()
+		defer cache.runtimes.mu.Unlock()
+		cache.bundles.mu.Lock()
+		defer cache.bundles.mu.Unlock()
+		return cache.runtimes.pinned["9.264.0"], cache.bundles.pinned[bundleURL("o", "r", "1.0.0")]
+	}
+
+	if code := pin(http.MethodPost); code != http.StatusNoContent {
+		t.Fatalf("POST /admin/pins = %d, want 204", code)
+	}
+	if runtime, bundle := pinned(); !runtime || !bundle {
+		t.Errorf("after POST /admin/pins runtime pinned = %t, bundle pinned = %t, want both", runtime, bundle)
+	}
+
+	if code := pin(http.MethodDelete); code != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/pins = %d, want 204", code)
+	}
+	if runtime, bundle := pinned(); runtime || bundle {
+		t.Errorf("after DELETE /admin/pins runtime pinned = %t, bundle pinned = %t, want neither", runtime, bundle)
+	}
+}
+
+func TestRuntimeAndBundleCachesEvictIndependently(t *testing.T) {
+	limit := func(runtimes, bundles storeLimits) {
+		cache.runtimes.mu.Lock()
+		cache.runtimes.limits = runtimes
+		cache.runtimes.mu.Unlock()
+		cache.bundles.mu.Lock()
+		cache.bundles.limits = bundles
+		cache.bundles.mu.Unlock()
+	}
+	runtimeLimits, bundleLimits := cache.runtimes.limits, cache.bundles.limits
+	t.Cleanup(func() { limit(runtimeLimits, bundleLimits) })
+	limit(storeLimits{entries: 2}, storeLimits{entries: 3})
+
+	cache.bundles.store("test-269/bundle", Bundle{Data: []byte("bundle"), Hash: "bundle"}, 0)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("9.269.%d", i)
+		cache.runtimes.store(key, Runtime{Hash: key}, 0)
+	}
+	if n := cache.runtimes.len(); n != 2 {
+		t.Errorf("runtime cache holds %d entries, want its own limit of 2", n)
+	}
+	if _, ok := cache.bundles.load("test-269/bundle"); !ok {
+		t.Error("filling the runtime cache evicted a bundle")
+	}
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("test-269/bundle-%d", i)
+		cache.bundles.store(key, Bundle{Data: []byte(key), Hash: key}, 0)
+	}
+	if n := cache.bundles.len(); n != 3 {
+		t.Errorf("bundle cache holds %d entries, want its own limit of 3", n)
+	}
+	for _, key := range []string{"9.269.3", "9.269.4"} {
+		if _, ok := cache.runtimes.load(key); !ok {
+			t.Errorf("filling the bundle cache evicted runtime %s", key)
+		}
+	}
+}
+
+func TestEntryEvictedMidStreamCompletes(t *testing.T) {
+	payload := strings.Repeat("held bundle bytes ", 1<<19)
+	bundle := sevenZipArchive(t, "main.lua", payload)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bundle)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	limits := cache.bundles.limits
+	t.Cleanup(func() {
+		cache.bundles.mu.Lock()
+		cache.bundles.limits = limits
+		cache.bundles.mu.Unlock()
+	})
+	srv := httptest.NewServer(newServer())
+	defer srv.Close()
+
+	key := bundleURL("o", "held", "1.0.0")
+	// Unlike load, this doesn't mark the entry recently used.
+	cached := func() bool {
+		cache.bundles.mu.Lock()
+		defer cache.bundles.mu.Unlock()
+		_, ok := cache.bundles.entries[key]
+		return ok
+	}
+
+	// Both the bundle itself and a file decoded from it keep the bundle
+	// held until the response is done.
+	for _, tc := range []struct {
+		path string
+		want []byte
+	}{
+		{"bundle.7z", bundle},
+		{"files/main.lua", []byte(payload)},
+	} {
+		cache.bundles.mu.Lock()
+		cache.bundles.limits = limits
+		cache.bundles.mu.Unlock()
+		cache.bundles.purge(key)
+
+		resp, err := http.Get(srv.URL + "/9.280.0/o/held/1.0.0/720p/" + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		defer resp.Body.Close()
+
+		head := make([]byte, 4096)
+		if _, err := io.ReadFull(resp.Body, head); err != nil {
+			t.Fatalf("read the start of %s: %v", tc.path, err)
+		}
+
+		// With the response stalled on the socket, push the store past a
+		// limit of one entry.
+		cache.bundles.mu.Lock()
+		cache.bundles.limits = storeLimits{entries: 1}
+		cache.bundles.mu.Unlock()
+		for i := 0; i < 3; i++ {
+			other := fmt.Sprintf("test-280/bundle-%d", i)
+			cache.bundles.store(other, Bundle{Data: []byte(other), Hash: other}, 0)
+		}
+		if !cached() {
+			t.Fatalf("bundle evicted while %s was still streaming", tc.path)
+		}
+
+		rest, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read the rest of %s: %v", tc.path, err)
+		}
+		if got := append(head, rest...); !bytes.Equal(got, tc.want) {
+			t.Fatalf("streamed %s is %d bytes and differs from the %d byte original", tc.path, len(got), len(tc.want))
+		}
+		resp.Body.Close()
+
+		// Once its reader is gone the deferred eviction catches up.
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+			if !cached() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("bundle outlived the last reader of %s past the entry limit", tc.path)
+			}
+		}
+	}
+}
+
+func TestEvictionsAreLoggedWithReason(t *testing.T) {
+	resetState(t)
+	entry := func(size int) Runtime {
+		script := strings.Repeat("x", size)
+		return Runtime{Script: []byte(script), Hash: script}
+	}
+
+	for _, tc := range []struct {
+		reason string
+		limits storeLimits
+		evict  func(*store[Runtime])
+	}{
+		{"entries", storeLimits{entries: 1}, func(s *store[Runtime]) { s.store("b", entry(1), 0) }},
+		{"bytes", storeLimits{bytes: 4}, func(s *store[Runtime]) { s.store("b", entry(2), 0) }},
+		{"manual", storeLimits{}, func(s *store[Runtime]) { s.purge("a") }},
+		{"memory", storeLimits{}, func(s *store[Runtime]) { s.shed(1, "memory") }},
+	} {
+		logs := captureLogs(t)
+		kind := "test-283-" + tc.reason
+		counted := evictions.WithLabelValues(kind, tc.reason)
+		s := newStore(kind, tc.limits, func(r Runtime) string { return r.Hash }, runtimeSize)
+		s.store("a", entry(3), 0)
+		tc.evict(s)
+
+		if _, ok := s.load("a"); ok {
+			t.Errorf("%s: entry was not evicted", tc.reason)
+		}
+		for _, want := range []string{"cache eviction", "kind=" + kind, "key=a", "size=3", "age=", "reason=" + tc.reason} {
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("%s eviction log does not contain %s:\n%s", tc.reason, want, logs)
+			}
+		}
+		if n := counterValue(t, counted); n != 1 {
+			t.Errorf("%s evictions counted %v, want 1", tc.reason, n)
+		}
+	}
+
+	logs := captureLogs(t)
+	t.Setenv("LOG_EVICTIONS", "false")
+	s := newStore("test-283-quiet", storeLimits{entries: 1}, func(r Runtime) string { return r.Hash }, runtimeSize)
+	s.store("a", entry(1), 0)
+	s.store("b", entry(2), 0)
+	if strings.Contains(logs.String(), "cache eviction") {
+		t.Errorf("eviction logged with LOG_EVICTIONS=false:\n%s", logs)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// cacheKey scopes key to the tenant carried by ctx, so that tenants with the
+// same runtime or release never share cached entries.
+func cacheKey(ctx context.Context, key string) string {
+	if tenant := tenantFrom(ctx); tenant != "" {
+		return tenant + "|" + key
+	}
+	return key
+}
+
+func requestTenant(r *http.Request, header, domain string) string {
+	if header != "" {
+		if tenant := r.Header.Get(header); tenant != "" {
+			return strings.ToLower(tenant)
+		}
+	}
+
+	if domain != "" {
+		host, _, _ := strings.Cut(r.Host, ":")
+		if sub, ok := strings.CutSuffix(strings.ToLower(host), "."+domain); ok {
+			return sub
+		}
+	}
+
+	return ""
+}
+
+// tenant scopes requests to the tenant named by header or subdomain. Only
+// tenants listed in allowed are accepted: ids are client supplied, and
+// letting anyone mint one would let them multiply upstream fetches and push
+// other tenants' entries out of the cache.
+func tenant(header, domain, allowed string) echo.MiddlewareFunc {
+	known := map[string]bool{}
+	for _, id := range strings.Split(allowed, ",") {
+		if id = strings.ToLower(strings.TrimSpace(id)); id != "" {
+			known[id] = true
+		}
+	}
+
+	if (header != "" || domain != "") && len(known) == 0 {
+		slog.Error("TENANT_HEADER and TENANT_DOMAIN need TENANTS, ignoring them")
+		header, domain = "", ""
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if header == "" && domain == "" {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			id := requestTenant(c.Request(), header, domain)
+			if id == "" {
+				return next(c)
+			}
+
+			if !known[id] {
+				return echo.NewHTTPError(http.StatusForbidden, "unknown tenant")
+			}
+
+			c.SetRequest(c.Request().WithContext(withTenant(c.Request().Context(), id)))
+			return next(c)
+		}
+	}
+}
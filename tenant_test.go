@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTenantsAreCachedSeparately(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('tenant')", "carimbo.wasm", "\x00asm tenant")
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("TENANTS", "acme, globex")
+	t.Setenv("TENANT_HEADER", "X-Tenant")
+	e := newServer()
+
+	get := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/9.246.0/o/r/1.0.0/720p/carimbo.js", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		tenant, cache string
+	}{
+		{"acme", "MISS"},
+		{"ACME", "HIT"},
+		{"globex", "MISS"},
+		{"globex", "HIT"},
+		{"", "MISS"},
+	} {
+		rec := get(tc.tenant)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET as tenant %q = %d: %s", tc.tenant, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Cache"); got != tc.cache {
+			t.Errorf("GET as tenant %q X-Cache = %s, want %s", tc.tenant, got, tc.cache)
+		}
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("upstream hits = %d, want one per tenant", n)
+	}
+
+	for key, want := range map[string]bool{
+		"acme|9.246.0":   true,
+		"globex|9.246.0": true,
+		"9.246.0":        true,
+	} {
+		if _, ok := cache.runtimes.load(key); ok != want {
+			t.Errorf("runtime cached under %q = %t, want %t", key, ok, want)
+		}
+	}
+
+	if rec := get("initech"); rec.Code != http.StatusForbidden {
+		t.Errorf("GET as an unlisted tenant = %d, want 403", rec.Code)
+	}
+}
+
+func TestRequestTenantFromSubdomain(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "Acme.play.example:8080"
+	if got := requestTenant(req, "", "play.example"); got != "acme" {
+		t.Errorf("tenant from %s = %q, want acme", req.Host, got)
+	}
+
+	req.Host = "play.example"
+	if got := requestTenant(req, "", "play.example"); got != "" {
+		t.Errorf("tenant from the bare domain = %q, want none", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type timingKey struct{}
+
+type timings struct {
+	mu    sync.Mutex
+	names []string
+	total map[string]time.Duration
+}
+
+func (t *timings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.total[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.total[name] += d
+}
+
+func (t *timings) header(total time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parts := make([]string, 0, len(t.names)+1)
+	for _, name := range t.names {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", name, float64(t.total[name].Microseconds())/1000))
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.1f", float64(total.Microseconds())/1000))
+	return strings.Join(parts, ", ")
+}
+
+func recordTiming(ctx context.Context, name string, start time.Time) {
+	if t, ok := ctx.Value(timingKey{}).(*timings); ok {
+		t.add(name, time.Since(start))
+	}
+}
+
+func serverTiming(enabled bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !enabled {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			start := time.Now()
+			t := &timings{total: make(map[string]time.Duration)}
+			c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), timingKey{}, t)))
+
+			c.Response().Before(func() {
+				c.Response().Header().Set("Server-Timing", t.header(time.Since(start)))
+			})
+
+			return next(c)
+		}
+	}
+}
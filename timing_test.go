@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var serverTimingFormat = regexp.MustCompile(`^[a-z]+;dur=\d+\.\d(, [a-z]+;dur=\d+\.\d)*$`)
+
+func timingNames(header string) []string {
+	var names []string
+	for _, part := range strings.Split(header, ", ") {
+		name, _, _ := strings.Cut(part, ";")
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestServerTiming(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('timing')", "carimbo.wasm", "\x00asm timing")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	e := newServer()
+
+	for _, tc := range []struct {
+		path  string
+		names string
+	}{
+		{"/9.238.0/o/r/1.0.0/720p/carimbo.js", "upstream rewrite total"},
+		{"/9.238.0/o/r/1.0.0/720p/carimbo.js", "total"},
+		{"/healthz", "total"},
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+		header := rec.Header().Get("Server-Timing")
+		if !serverTimingFormat.MatchString(header) {
+			t.Errorf("GET %s Server-Timing = %q, not name;dur=ms entries", tc.path, header)
+			continue
+		}
+		if got := strings.Join(timingNames(header), " "); got != tc.names {
+			t.Errorf("GET %s Server-Timing metrics = %s, want %s", tc.path, got, tc.names)
+		}
+	}
+
+	t.Setenv("SERVER_TIMING", "false")
+	rec := httptest.NewRecorder()
+	newServer().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if got := rec.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing with SERVER_TIMING=false = %q, want none", got)
+	}
+}
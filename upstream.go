@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errTruncated        = errors.New("truncated upstream response")
+	errCorrupt          = errors.New("corrupt upstream archive")
+	errMalformedRuntime = errors.New("malformed runtime")
+	errUpstreamNotFound = errors.New("upstream not found")
+	errUpstreamHTML     = errors.New("upstream returned html")
+	errTooLarge         = errors.New("upstream response too large")
+)
+
+type notFoundError struct {
+	subject string
+	err     error
+}
+
+func (e *notFoundError) Error() string {
+	return e.subject + " not found"
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.err
+}
+
+func upstreamStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s", errUpstreamNotFound, resp.Request.URL)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("upstream status: %s", resp.Status)
+	}
+	return nil
+}
+
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+type dnsCache struct {
+	resolver resolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+func newDNSCache(r resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{resolver: r, ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup host error: %w", err)
+	}
+
+	d.mu.Lock()
+	d.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+
+	return addrs, nil
+}
+
+func (d *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("split host port error: %w", err)
+		}
+
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, lastErr
+	}
+}
+
+func isGitHubHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range []string{"github.com", "githubusercontent.com"} {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func upstreamProxy(githubProxy *url.URL) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if githubProxy != nil && isGitHubHost(req.URL.Hostname()) {
+			return githubProxy, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+}
+
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	var githubProxy *url.URL
+	if raw := os.Getenv("GITHUB_PROXY"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			slog.Error("invalid GITHUB_PROXY, ignoring", "value", raw, "error", err)
+		} else {
+			githubProxy = u
+		}
+	}
+	transport.Proxy = upstreamProxy(githubProxy)
+	transport.ResponseHeaderTimeout = envDuration("UPSTREAM_HEADER_TIMEOUT", 30*time.Second)
+
+	if ttl := envDuration("UPSTREAM_DNS_TTL", 0); ttl > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = newDNSCache(net.DefaultResolver, ttl).dialContext(dialer)
+	}
+
+	return transport
+}
+
+var (
+	upstream = &http.Client{Transport: newUpstreamTransport(), Timeout: envDuration("UPSTREAM_TIMEOUT", 5*time.Minute)}
+	fetches  = newFairScheduler(
+		envInt("UPSTREAM_CONCURRENCY", 0),
+		envInt("UPSTREAM_QUEUE_LIMIT", 0),
+		envInt("UPSTREAM_BACKGROUND_CONCURRENCY", envInt("UPSTREAM_CONCURRENCY", 0)/2),
+	)
+)
+
+func githubURL() string {
+	return strings.TrimSuffix(envString("GITHUB_URL", "https://github.com"), "/")
+}
+
+// redactURL hides credentials a configured base may carry, either as userinfo
+// or in a token-style query parameter.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparseable url]"
+	}
+
+	u.RawQuery = redactQuery(u.Query())
+	return u.Redacted()
+}
+
+// redactQuery encodes query with token-style parameters masked.
+func redactQuery(query url.Values) string {
+	for key := range query {
+		if k := strings.ToLower(key); strings.Contains(k, "token") || strings.Contains(k, "key") || strings.Contains(k, "sig") {
+			query.Set(key, "xxxxx")
+		}
+	}
+	return query.Encode()
+}
+
+// debugUpstreamHeader reports the upstream URL a request maps to when
+// DEBUG_UPSTREAM_URL is on. It is set before fetching so it survives into
+// error responses, where a misconfigured base shows up most.
+func debugUpstreamHeader(c echo.Context, resolve func() (string, error)) {
+	if !envBool("DEBUG_UPSTREAM_URL", false) {
+		return
+	}
+
+	if u, err := resolve(); err == nil {
+		c.Response().Header().Set("X-Debug-Upstream-URL", redactURL(u))
+	}
+}
+
+// doUpstream sends req with the provider's credentials. When they are
+// rejected with a 401 and ANONYMOUS_FALLBACK is on, it tries once more
+// without them, since an expired token shouldn't break public assets.
+func doUpstream(req *http.Request) (*http.Response, error) {
+	currentProvider().authorize(req)
+
+	resp, err := upstream.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !anonymousFallback() {
+		return resp, err
+	}
+	if req.Header.Get("Authorization") == "" && req.Header.Get("PRIVATE-TOKEN") == "" {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	slog.Warn("upstream credentials rejected, retrying anonymously", "url", redactURL(req.URL.String()))
+
+	anonymous := req.Clone(req.Context())
+	anonymous.Header.Del("Authorization")
+	anonymous.Header.Del("PRIVATE-TOKEN")
+	return upstream.Do(anonymous)
+}
+
+func anonymousFallback() bool {
+	return envBool("ANONYMOUS_FALLBACK", true)
+}
+
+// downloadOnce streams url into memory, bounded by UPSTREAM_MAX_BYTES, and
+// tees every chunk into stage as it arrives; stage may be nil.
+func downloadOnce(ctx context.Context, url string, stage io.Writer) ([]byte, error) {
+	release, err := fetches.acquire(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	defer trackDownload()()
+	defer recordTiming(ctx, "upstream", time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request error: %w", err)
+	}
+
+	resp, err := doUpstream(req)
+	if err != nil {
+		return nil, fmt.Errorf("http get error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := upstreamStatus(resp); err != nil {
+		return nil, err
+	}
+
+	limit := int64(envInt("UPSTREAM_MAX_BYTES", 1<<30))
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes over the %d limit", errTooLarge, resp.ContentLength, limit)
+	}
+
+	var buf bytes.Buffer
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength))
+	}
+	if stage == nil {
+		stage = io.Discard
+	}
+
+	if _, err := copyContext(ctx, io.MultiWriter(&buf, stage), io.LimitReader(resp.Body, limit+1)); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("read error: %w: %w", errTruncated, err)
+		}
+		return nil, fmt.Errorf("read error: %w", err)
+	}
+	body := buf.Bytes()
+
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: over the %d limit", errTooLarge, limit)
+	}
+	if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+		return nil, fmt.Errorf("%w: got %d of %d bytes", errTruncated, len(body), resp.ContentLength)
+	}
+
+	if isHTML(resp.Header.Get("Content-Type"), body) {
+		upstreamHTML.Inc()
+		return nil, fmt.Errorf("%w: %s", errUpstreamHTML, url)
+	}
+
+	return body, nil
+}
+
+// isHTML spots login pages and interstitials served with a 200 in place of
+// the archive we asked for.
+func isHTML(contentType string, body []byte) bool {
+	if strings.HasPrefix(contentType, "text/html") {
+		return true
+	}
+	return strings.HasPrefix(http.DetectContentType(body), "text/html")
+}
+
+type retryBudgetKey struct{}
+
+func withRetryBudget(ctx context.Context, budget time.Duration) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, time.Now().Add(budget))
+}
+
+func retryAllowed(ctx context.Context, wait time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	deadline, ok := ctx.Value(retryBudgetKey{}).(time.Time)
+	return !ok || time.Now().Add(wait).Before(deadline)
+}
+
+func backoff(attempt int) time.Duration {
+	return envDuration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond) << attempt
+}
+
+func upstreamTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func retryable(err error) bool {
+	return errors.Is(err, errTruncated) || errors.Is(err, errCorrupt) || upstreamTimeout(err)
+}
+
+// stageDisk starts the disk cache copy of url, or returns nil when there is
+// no disk cache or it is not taking writes.
+func stageDisk(ctx context.Context, url string) *diskWriter {
+	if disk == nil {
+		return nil
+	}
+
+	stage, err := disk.create(cacheKey(ctx, url), cacheTTL(ctx))
+	if err != nil {
+		slog.Warn("disk cache write failed", "key", url, "error", err)
+	}
+	return stage
+}
+
+func download(ctx context.Context, url string, validate func([]byte) error) ([]byte, error) {
+	if useDiskCache(ctx) {
+		if body, ok := disk.Get(cacheKey(ctx, url)); ok && (validate == nil || validate(body) == nil) {
+			return body, nil
+		}
+	}
+
+	retries := envInt("UPSTREAM_RETRIES", 2)
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			wait := backoff(attempt - 1)
+			if !retryAllowed(ctx, wait) {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		stage := stageDisk(ctx, url)
+		var sink io.Writer
+		if stage != nil {
+			sink = stage
+		}
+
+		var body []byte
+		if body, err = downloadOnce(ctx, url, sink); err == nil && validate != nil {
+			err = validate(body)
+		}
+		if err == nil {
+			if stage != nil {
+				if err := stage.commit(); err != nil {
+					slog.Warn("disk cache write failed", "key", url, "error", err)
+				}
+			}
+			return body, nil
+		}
+		if stage != nil {
+			stage.abort()
+		}
+
+		if !retryable(err) {
+			if !errors.Is(err, errUpstreamNotFound) && !errors.Is(err, errOverloaded) {
+				upstreamFailures.Inc()
+			}
+			return nil, err
+		}
+	}
+
+	if ctx.Err() == nil {
+		upstreamFailures.Inc()
+		retriesExhausted(url, err)
+	}
+	return nil, err
+}
+
+type retryExhaustion struct {
+	URL   string    `json:"url"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// retriesExhausted counts a download that failed every attempt the retry
+// budget allowed and, with RETRY_EXHAUSTED_WEBHOOK set, posts it there in the
+// background so alerting never holds up the request.
+func retriesExhausted(url string, err error) {
+	upstreamExhausted.Inc()
+
+	hook := os.Getenv("RETRY_EXHAUSTED_WEBHOOK")
+	if hook == "" {
+		return
+	}
+
+	body, merr := json.Marshal(retryExhaustion{URL: redactURL(url), Error: err.Error(), Time: time.Now()})
+	if merr != nil {
+		slog.Error("encode retry webhook error", "error", merr)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("RETRY_EXHAUSTED_WEBHOOK_TIMEOUT", 5*time.Second))
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			slog.Error("retry webhook request error", "error", err)
+			return
+		}
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			slog.Warn("retry webhook failed", "error", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			slog.Warn("retry webhook rejected", "status", resp.Status)
+		}
+	}()
+}
+
+func upstreamSize(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("http request error: %w", err)
+	}
+
+	resp, err := doUpstream(req)
+	if err != nil {
+		return 0, fmt.Errorf("http head error: %w", err)
+	}
+	resp.Body.Close()
+
+	if err := upstreamStatus(resp); err != nil {
+		return 0, err
+	}
+
+	return resp.ContentLength, nil
+}
+
+func streamUpstream(ctx context.Context, url string, c echo.Context, contentType string) error {
+	defer trackDownload()()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("http request error: %w", err)
+	}
+
+	resp, err := doUpstream(req)
+	if err != nil {
+		return fmt.Errorf("http get error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := upstreamStatus(resp); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	if resp.ContentLength >= 0 {
+		c.Response().Header().Set(echo.HeaderContentLength, fmt.Sprint(resp.ContentLength))
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+
+	if _, err := copyContext(ctx, c.Response(), resp.Body); err != nil {
+		return fmt.Errorf("stream error: %w", err)
+	}
+	return nil
+}
+
+func fetchError(err error) error {
+	var nf *notFoundError
+	if errors.As(err, &nf) {
+		return echo.NewHTTPError(http.StatusNotFound, nf.Error()).SetInternal(err)
+	}
+	if errors.Is(err, errTruncated) {
+		return echo.NewHTTPError(http.StatusBadGateway, "upstream download truncated").SetInternal(err)
+	}
+	if errors.Is(err, errCorrupt) {
+		return echo.NewHTTPError(http.StatusBadGateway, "corrupt upstream archive").SetInternal(err)
+	}
+	if errors.Is(err, errUpstreamHTML) {
+		return echo.NewHTTPError(http.StatusBadGateway, "upstream returned an HTML page instead of an archive").SetInternal(err)
+	}
+	if errors.Is(err, errTooLarge) {
+		return echo.NewHTTPError(http.StatusBadGateway, "upstream response too large").SetInternal(err)
+	}
+	if upstreamTimeout(err) {
+		return echo.NewHTTPError(http.StatusGatewayTimeout, "upstream timed out").SetInternal(err)
+	}
+	if errors.Is(err, errNoReleaseListing) {
+		return echo.NewHTTPError(http.StatusNotImplemented, "the configured upstream provider cannot list releases").SetInternal(err)
+	}
+	if errors.Is(err, errOverloaded) {
+		return serviceUnavailable(causeOverload, "too many upstream fetches queued", err)
+	}
+	if errors.Is(err, errMalformedRuntime) {
+		return echo.NewHTTPError(http.StatusBadGateway, "malformed runtime").SetInternal(err)
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type WarmBundle struct {
+	Organization string `json:"org"`
+	Repository   string `json:"repo"`
+	Release      string `json:"release"`
+}
+
+// WarmPair is a runtime and the bundle it plays; both halves are fetched
+// concurrently and the pair only counts as done once both are cached.
+type WarmPair struct {
+	Runtime string     `json:"runtime"`
+	Bundle  WarmBundle `json:"bundle"`
+}
+
+type WarmRequest struct {
+	Runtimes []string     `json:"runtimes"`
+	Bundles  []WarmBundle `json:"bundles"`
+	Pairs    []WarmPair   `json:"pairs"`
+	Refresh  bool         `json:"refresh"`
+}
+
+type WarmJob struct {
+	ID       string
+	Total    int
+	Done     int64
+	Failed   int64
+	Finished bool
+
+	mu     sync.Mutex
+	errors []string
+}
+
+type WarmStatus struct {
+	ID       string   `json:"id"`
+	Total    int      `json:"total"`
+	Done     int64    `json:"done"`
+	Failed   int64    `json:"failed"`
+	Finished bool     `json:"finished"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+const warmJobRetention = time.Hour
+
+var warmJobs sync.Map
+
+// Warm jobs share a small pool of workers so a large batch stays bounded; their
+// downloads then run as background fetches, which live requests take
+// precedence over in the upstream scheduler.
+var warmSlots = make(chan struct{}, max(envInt("WARM_CONCURRENCY", 2), 1))
+
+func acquireWarmSlot() func() {
+	warmSlots <- struct{}{}
+	return func() { <-warmSlots }
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("random id error: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (j *WarmJob) fail(err error) {
+	atomic.AddInt64(&j.Failed, 1)
+	j.mu.Lock()
+	j.errors = append(j.errors, err.Error())
+	j.mu.Unlock()
+}
+
+func (j *WarmJob) Status() WarmStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return WarmStatus{
+		ID:       j.ID,
+		Total:    j.Total,
+		Done:     atomic.LoadInt64(&j.Done),
+		Failed:   atomic.LoadInt64(&j.Failed),
+		Finished: j.Finished,
+		Errors:   append([]string(nil), j.errors...),
+	}
+}
+
+func validWarmTag(tag string) bool {
+	return tag == latestAlias || tagPattern.MatchString(tag)
+}
+
+// resolveWarmTag settles a latest alias and checks the result against
+// RELEASE_TAG_PATTERN, as resolveParams does for requests.
+func resolveWarmTag(ctx context.Context, org, repo, tag string) (string, error) {
+	if tag == latestAlias {
+		version, err := resolveLatest(ctx, org, repo, false)
+		if err != nil {
+			return "", fmt.Errorf("resolve latest error: %w", err)
+		}
+		tag = version
+	}
+
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag: %s", tag)
+	}
+	return tag, nil
+}
+
+func warmRuntime(ctx context.Context, runtime string, refresh bool) error {
+	defer acquireWarmSlot()()
+	version, err := resolveWarmTag(ctx, runtimeOrganization, runtimeRepository, runtime)
+	if err != nil {
+		return fmt.Errorf("runtime %s: %w", runtime, err)
+	}
+
+	fetch := getRuntime
+	if refresh {
+		fetch = refreshRuntime
+	}
+	if _, _, err := fetch(ctx, version); err != nil {
+		return fmt.Errorf("runtime %s: %w", runtime, err)
+	}
+	return nil
+}
+
+func warmBundle(ctx context.Context, b WarmBundle, refresh bool) error {
+	defer acquireWarmSlot()()
+	release, err := resolveWarmTag(ctx, b.Organization, b.Repository, b.Release)
+	if err != nil {
+		return fmt.Errorf("bundle %s/%s/%s: %w", b.Organization, b.Repository, b.Release, err)
+	}
+
+	fetch := getBundle
+	if refresh {
+		fetch = refreshBundle
+	}
+	if _, _, err := fetch(ctx, b.Organization, b.Repository, release); err != nil {
+		return fmt.Errorf("bundle %s/%s/%s: %w", b.Organization, b.Repository, b.Release, err)
+	}
+	return nil
+}
+
+func (j *WarmJob) run(ctx context.Context, req WarmRequest) {
+	var wg sync.WaitGroup
+
+	for _, runtime := range req.Runtimes {
+		wg.Add(1)
+		go func(runtime string) {
+			defer wg.Done()
+			if err := warmRuntime(ctx, runtime, req.Refresh); err != nil {
+				j.fail(err)
+				return
+			}
+			atomic.AddInt64(&j.Done, 1)
+		}(runtime)
+	}
+
+	for _, bundle := range req.Bundles {
+		wg.Add(1)
+		go func(b WarmBundle) {
+			defer wg.Done()
+			if err := warmBundle(ctx, b, req.Refresh); err != nil {
+				j.fail(err)
+				return
+			}
+			atomic.AddInt64(&j.Done, 1)
+		}(bundle)
+	}
+
+	for _, pair := range req.Pairs {
+		wg.Add(1)
+		go func(pair WarmPair) {
+			defer wg.Done()
+
+			errs := make(chan error, 2)
+			go func() { errs <- warmRuntime(ctx, pair.Runtime, req.Refresh) }()
+			go func() { errs <- warmBundle(ctx, pair.Bundle, req.Refresh) }()
+
+			if err := errors.Join(<-errs, <-errs); err != nil {
+				j.fail(err)
+				return
+			}
+			atomic.AddInt64(&j.Done, 1)
+		}(pair)
+	}
+
+	wg.Wait()
+
+	j.mu.Lock()
+	j.Finished = true
+	j.mu.Unlock()
+
+	time.AfterFunc(warmJobRetention, func() { warmJobs.Delete(j.ID) })
+}
+
+func startWarm(ctx context.Context, req WarmRequest) (*WarmJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &WarmJob{ID: id, Total: len(req.Runtimes) + len(req.Bundles) + len(req.Pairs)}
+	warmJobs.Store(id, job)
+	go job.run(withBackground(ctx), req)
+
+	return job, nil
+}
+
+func warmHandler(c echo.Context) error {
+	req := WarmRequest{}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid warm request")
+	}
+
+	for _, runtime := range req.Runtimes {
+		if !validWarmTag(runtime) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid runtime tag: %s", runtime))
+		}
+	}
+
+	for _, b := range req.Bundles {
+		if b.Organization == "" || b.Repository == "" || b.Release == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "bundles require org, repo and release")
+		}
+		if !validWarmTag(b.Release) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid release tag: %s", b.Release))
+		}
+	}
+
+	for _, pair := range req.Pairs {
+		if b := pair.Bundle; pair.Runtime == "" || b.Organization == "" || b.Repository == "" || b.Release == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "pairs require a runtime and a bundle with org, repo and release")
+		}
+		if !validWarmTag(pair.Runtime) || !validWarmTag(pair.Bundle.Release) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid runtime or release tag in pair")
+		}
+	}
+
+	job, err := startWarm(withTenant(context.Background(), tenantFrom(c.Request().Context())), req)
+	if err != nil {
+		return fmt.Errorf("start warm error: %w", err)
+	}
+
+	return c.JSON(http.StatusAccepted, job.Status())
+}
+
+func warmStatusHandler(c echo.Context) error {
+	job, ok := warmJobs.Load(c.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown warm job")
+	}
+
+	return c.JSON(http.StatusOK, job.(*WarmJob).Status())
+}
+
+// prefetch starts a warm job for PREFETCH, a comma separated list of
+// "runtime@org/repo/release" pairs, so a fresh instance has its playgrounds
+// ready before the first visitor arrives.
+func prefetch() {
+	req := WarmRequest{}
+	for _, spec := range strings.Split(os.Getenv("PREFETCH"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		runtime, rest, _ := strings.Cut(spec, "@")
+		bundle, ok := parseBundleSpec(rest)
+		if runtime == "" || !ok || !validWarmTag(runtime) || !validWarmTag(bundle.Release) {
+			slog.Warn("ignoring invalid prefetch entry", "value", spec)
+			continue
+		}
+		req.Pairs = append(req.Pairs, WarmPair{Runtime: runtime, Bundle: bundle})
+	}
+
+	if len(req.Pairs) == 0 {
+		return
+	}
+
+	if _, err := startWarm(context.Background(), req); err != nil {
+		slog.Error("prefetch failed to start", "error", err)
+	}
+}
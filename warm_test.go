@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmRuntimeJob(t *testing.T) {
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('warm')", "carimbo.wasm", "\x00asm warm")
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/flippingpixels/carimbo/releases/download/v9.201.0/WebAssembly.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		w.Write(runtimeZip)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/warm", strings.NewReader(`{"runtimes":["9.201.0"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /admin/warm = %d, want 202: %s", rec.Code, rec.Body)
+	}
+
+	var status WarmStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode warm status: %v", err)
+	}
+	if status.ID == "" || status.Total != 1 {
+		t.Fatalf("warm status = %+v, want an id and one item", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !status.Finished {
+		if time.Now().After(deadline) {
+			t.Fatalf("warm job %s did not finish: %+v", status.ID, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/warm/"+status.ID, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /admin/warm/%s = %d: %s", status.ID, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decode warm status: %v", err)
+		}
+	}
+
+	if status.Done != 1 || status.Failed != 0 {
+		t.Fatalf("warm status = %+v, want one done and none failed", status)
+	}
+	if _, ok := cache.runtimes.load("9.201.0"); !ok {
+		t.Fatal("runtime 9.201.0 not cached after warming")
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream hits = %d, want 1", n)
+	}
+}
+
+func TestWarmRejectsInvalidTags(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	for _, body := range []string{
+		`{"runtimes":["../evil"]}`,
+		`{"bundles":[{"org":"o","repo":"r","release":"nope"}]}`,
+		`{"pairs":[{"runtime":"1.0.0","bundle":{"org":"o","repo":"r"}}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/warm", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST /admin/warm %s = %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestWarmRequiresAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	e := newServer()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/warm", strings.NewReader(`{"runtimes":["1.0.0"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusAccepted {
+		t.Fatalf("POST /admin/warm without a token = %d, want it refused", rec.Code)
+	}
+}
+
+func TestPrefetchWarmsRuntimeAndBundleTogether(t *testing.T) {
+	logs := captureLogs(t)
+	runtimeZip := zipArchive(t, "carimbo.js", "console.log('paired')", "carimbo.wasm", "\x00asm paired")
+	bundle := sevenZipArchive(t, "main.lua", "print('paired')")
+
+	// Each download waits for the other, so neither finishes unless both
+	// are in flight at once.
+	var arrivals sync.WaitGroup
+	arrivals.Add(2)
+	arrived := map[string]*sync.Once{"runtime": {}, "bundle": {}}
+	together := make(chan struct{})
+	go func() {
+		arrivals.Wait()
+		close(together)
+	}()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var kind string
+		var body []byte
+		switch r.URL.Path {
+		case "/flippingpixels/carimbo/releases/download/v9.288.0/WebAssembly.zip":
+			kind, body = "runtime", runtimeZip
+		case "/o/paired/releases/download/v1.0.0/bundle.7z":
+			kind, body = "bundle", bundle
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		arrived[kind].Do(arrivals.Done)
+		select {
+		case <-together:
+		case <-time.After(2 * time.Second):
+			http.Error(w, "fetched alone", http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("GITHUB_URL", upstream.URL)
+	t.Setenv("UPSTREAM_RETRIES", "0")
+	t.Setenv("PREFETCH", "9.288.0@o/paired/1.0.0, 9.288.1@nonsense")
+	cache.runtimes.purge("9.288.0")
+	cache.bundles.purge(bundleURL("o", "paired", "1.0.0"))
+	newServer()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, runtime := cache.runtimes.load("9.288.0")
+		_, bundle := cache.bundles.load(bundleURL("o", "paired", "1.0.0"))
+		if runtime && bundle {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after prefetch runtime cached = %t, bundle cached = %t, want both", runtime, bundle)
+		}
+	}
+	if !strings.Contains(logs.String(), "ignoring invalid prefetch entry") {
+		t.Errorf("invalid prefetch entry was not reported:\n%s", logs)
+	}
+}